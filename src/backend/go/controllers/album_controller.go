@@ -3,12 +3,13 @@ package controllers
 import (
 	"bos/pablo/helpers"
 	"bos/pablo/models"
+	"bos/pablo/services"
+	"bos/pablo/types"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -139,7 +140,7 @@ func UploadAndCreateAlbum(db *gorm.DB) gin.HandlerFunc {
 			}
 
 			// Generate flattened vector
-			flattenedVector, err := helpers.PreprocessImage(convertedPngPath, 120, 120)
+			flattenedVector, featureMeta, err := helpers.PreprocessImage(convertedPngPath, helpers.DefaultImagePreprocessing)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preprocess image"})
 				return
@@ -167,22 +168,99 @@ func UploadAndCreateAlbum(db *gorm.DB) gin.HandlerFunc {
 				Name:        filepath.Base(convertedPngPath),
 				PicFilePath: convertedPngPath,
 				Flattened:   flattenedFilePath,
+				FeatureMeta: &featureMeta,
 			}
 
 			if err := db.Create(&album).Error; err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create album"})
 				return
 			}
+
+			// Hash the cover for near-duplicate search
+			if err := services.HashAlbum(db, &album); err != nil {
+				fmt.Printf("Failed to hash album %s: %v\n", album.Name, err)
+			}
+
+			// Extract the cover colors for color-aware search
+			if err := services.ExtractAlbumColors(db, &album); err != nil {
+				fmt.Printf("Failed to extract the colors of album %s: %v\n", album.Name, err)
+			}
+
+			// Project the cover on the album PCA model. It is only part of the model's fit
+			// after the next rebuild
+			if err := services.ProjectAlbum(db, &album); err != nil {
+				fmt.Printf("Failed to project album %s: %v\n", album.Name, err)
+			}
 		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "Albums created successfully"})
 	}
 }
 
-// SearchByImage finds albums with similar cover images.
+// SearchByImage finds albums with similar cover images. The default vector mode compares the
+// preprocessed pixels with the metric parameter and keeps albums scoring above min_score;
+// mode=phash looks up near-duplicates by the Hamming distance of the hash parameter, within
+// max_distance bits.
 func SearchByImage(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		uploadFolder := "images"
+		lookup := formOrQuery(c)
+
+		mode := "vector"
+		if value, ok := lookup("mode"); ok && value != "" {
+			mode = value
+		}
+		if mode != "vector" && mode != "phash" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": `mode must be "vector" or "phash"`})
+			return
+		}
+
+		// Pick the image metric
+		metric := helpers.PictureMetricPCA
+		if value, ok := lookup("metric"); ok && value != "" {
+			metric = value
+		}
+		if err := helpers.LookupPictureMetric(metric); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Pick the score albums must beat, which depends on the metric's scale
+		minScore := services.ImageSearchMinScore(metric)
+		if value, ok := lookup("min_score"); ok && value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(parsed >= 0 && parsed < 1) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "min_score must be at least 0 and below 1"})
+				return
+			}
+			minScore = parsed
+		}
+
+		// Weigh grayscale against the color features
+		weights, err := helpers.ParseImageWeights(helpers.DefaultImageWeights, lookup)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Pick the hash and how far near-duplicates may be
+		hashName := helpers.HashPerceptual
+		if value, ok := lookup("hash"); ok && value != "" {
+			hashName = value
+		}
+		if _, err := (helpers.ImageHashes{}).Get(hashName); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		maxDistance := services.DefaultHashMaxDistance
+		if value, ok := lookup("max_distance"); ok && value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 || parsed > helpers.HashBits {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max_distance must be between 0 and %d", helpers.HashBits)})
+				return
+			}
+			maxDistance = parsed
+		}
 
 		// Save uploaded image
 		uploadedFilePaths, err := helpers.SaveUploadedFile(c, "public/uploads", uploadFolder)
@@ -203,71 +281,106 @@ func SearchByImage(db *gorm.DB) gin.HandlerFunc {
 			}
 		}
 
+		if mode == "phash" {
+			searchByHash(c, db, imageFilePath, hashName, maxDistance)
+			return
+		}
+
 		// Preprocess uploaded image
-		uploadedImageVector, err := helpers.PreprocessImage(imageFilePath, 120, 120)
+		uploadedImageVector, _, err := helpers.PreprocessImage(imageFilePath, helpers.DefaultImagePreprocessing)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preprocess image"})
 			return
 		}
 
-		// Fetch all albums with their songs
-		var albums []models.Album
-		if err := db.Preload("Songs").Find(&albums).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch albums"})
-			return
+		// Extract the colors of the uploaded image when they are weighted
+		var colors *types.ColorFeatures
+		if weights.UsesColor() {
+			extracted, err := helpers.ExtractColorFeaturesFile(imageFilePath)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extract image colors"})
+				return
+			}
+			colors = &extracted
 		}
 
 		// Start benchmarking
 		startTime := time.Now()
 
-		// Calculate similarity scores
-		var matchedAlbums []map[string]interface{}
-		for _, album := range albums {
-			if album.Flattened != "" {
-				// Read flattened vector from file
-				file, err := os.Open(album.Flattened)
-				if err != nil {
-					continue
-				}
-				defer file.Close()
+		matchedAlbums, err := services.SearchAlbumsByImage(db, uploadedImageVector, colors, metric, weights, minScore, services.ImageSearchTopK)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch albums"})
+			return
+		}
 
-				var albumVector []float64
-				err = json.NewDecoder(file).Decode(&albumVector)
-				if err != nil {
-					continue
-				}
+		// Check results and respond
+		if len(matchedAlbums) > 0 {
+			c.JSON(http.StatusOK, gin.H{"data": matchedAlbums, "time": time.Since(startTime).Seconds(), "mode": mode, "metric": metric, "minScore": minScore, "weights": weights})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"message": "No similar albums found"})
+		}
+	}
+}
 
-				// Compute similarity
-				similarity := helpers.CheckPictureSimilarity(uploadedImageVector, albumVector)
-				if similarity > 0.8 {
-					matchedAlbums = append(matchedAlbums, map[string]interface{}{
-						"ID":          album.ID,
-						"Name":        album.Name,
-						"PicFilePath": album.PicFilePath,
-						"Songs":       album.Songs,
-						"similarity":  similarity,
-					})
-				}
+// searchByHash answers a phash mode image search
+func searchByHash(c *gin.Context, db *gorm.DB, imageFilePath, hashName string, maxDistance int) {
+	// Start benchmarking
+	startTime := time.Now()
+
+	hashes, err := helpers.HashImageFile(imageFilePath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash image"})
+		return
+	}
+
+	matchedAlbums, err := services.SearchAlbumsByHash(db, hashes, hashName, maxDistance, services.ImageSearchTopK)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch albums"})
+		return
+	}
+
+	if len(matchedAlbums) > 0 {
+		c.JSON(http.StatusOK, gin.H{"data": matchedAlbums, "time": time.Since(startTime).Seconds(), "mode": "phash", "hash": hashName})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No similar albums found"})
+	}
+}
+
+// RebuildAlbumPCA refits the album PCA model over every album cover and reprojects all
+// albums. The optional components query parameter overrides PCA_COMPONENTS.
+func RebuildAlbumPCA(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		components := services.PCAComponents()
+		if value, ok := c.GetQuery("components"); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "components must be an integer"})
+				return
 			}
+			components = parsed
 		}
 
-		// Sort by similarity, handling type safety
-		sort.Slice(matchedAlbums, func(i, j int) bool {
-			simI := matchedAlbums[i]["similarity"].(float64)
-			simJ := matchedAlbums[j]["similarity"].(float64)
-			return simI > simJ
-		})
+		// Start benchmarking
+		startTime := time.Now()
 
-		// Limit results to top 9 matches
-		if len(matchedAlbums) > 9 {
-			matchedAlbums = matchedAlbums[:9]
+		model, err := services.RebuildAlbumPCA(db, components)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
-		// Check results and respond
-		if len(matchedAlbums) > 0 {
-			c.JSON(http.StatusOK, gin.H{"data": matchedAlbums, "time": time.Since(startTime).Seconds()})
-		} else {
-			c.JSON(http.StatusNotFound, gin.H{"message": "No similar albums found"})
+		var explained float64
+		for _, share := range model.ExplainedVariance {
+			explained += share
 		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":           "PCA model rebuilt successfully",
+			"id":                model.ID,
+			"albums":            model.AlbumCount,
+			"components":        len(model.Components),
+			"explainedVariance": model.ExplainedVariance,
+			"totalExplained":    explained,
+			"time":              time.Since(startTime).Seconds(),
+		})
 	}
 }
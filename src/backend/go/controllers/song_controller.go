@@ -3,12 +3,13 @@ package controllers
 import (
 	"bos/pablo/helpers"
 	"bos/pablo/models"
+	"bos/pablo/services"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
-	"sync"
 	"time"
 
 	"path/filepath"
@@ -56,18 +57,25 @@ func GetAllSongsWithPagination(db *gorm.DB) gin.HandlerFunc {
 			pageSize = 10
 		}
 
+		// Optional filters on the song analysis, e.g. ?key=A minor&min_tempo=100
+		filters, err := services.ParseSongFilters(c.GetQuery)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		offset := (page - 1) * pageSize
 
 		// Get the total count of matching records
 		var totalItems int64
-		if err := db.Model(&models.Song{}).Where("name LIKE ?", search).Count(&totalItems).Error; err != nil {
+		if err := filters.Apply(db.Model(&models.Song{})).Where("name LIKE ?", search).Count(&totalItems).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve record count"})
 			return
 		}
 
 		// Retrieve the paginated records
 		modelSlice := &[]models.Song{}
-		query := db.Order("id DESC").Where("name LIKE ?", search)
+		query := filters.Apply(db).Order("id DESC").Where("name LIKE ?", search)
 		if err := query.Limit(pageSize).Offset(offset).Find(modelSlice).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve records"})
 			return
@@ -83,7 +91,7 @@ func GetAllSongsWithPagination(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
+func UploadAndCreateSong(db *gorm.DB, converters helpers.ConverterSet) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		relativePath := "songs"
 
@@ -99,7 +107,7 @@ func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
 			var songs []models.Song
 			for _, filePath := range extractedPaths {
 				// Convert each extracted file to .midi if needed
-				convertedMidiPath, jsonPath, err := helpers.ConvertToMidi(filePath)
+				convertedMidiPath, jsonPath, err := converters.Songs.Convert(c.Request.Context(), filePath)
 
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert file to MIDI"})
@@ -124,6 +132,23 @@ func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
 				return
 			}
 
+			// Extract the melody, precompute its features, analyze the song and fingerprint WAV
+			// audio. Songs that fail here can be fixed with the reindex and fingerprint commands
+			for i := range songs {
+				if _, err := services.ExtractSongMelody(db, &songs[i]); err != nil {
+					fmt.Printf("Failed to extract melody of song %s: %v\n", songs[i].Name, err)
+				}
+				if err := services.IndexSong(db, &songs[i]); err != nil {
+					fmt.Printf("Failed to index song %s: %v\n", songs[i].Name, err)
+				}
+				if err := services.AnalyzeSong(db, &songs[i]); err != nil {
+					fmt.Printf("Failed to analyze song %s: %v\n", songs[i].Name, err)
+				}
+				if _, err := services.FingerprintSong(db, &songs[i]); err != nil && !errors.Is(err, services.ErrNotFingerprintable) {
+					fmt.Printf("Failed to fingerprint song %s: %v\n", songs[i].Name, err)
+				}
+			}
+
 			c.JSON(http.StatusOK, gin.H{
 				"message":        "ZIP file uploaded and extracted successfully",
 				"extractedFiles": extractedPaths,
@@ -136,7 +161,7 @@ func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
 			var jsonPath string
 
 			// Convert the uploaded file to .midi (use an external tool or library)
-			convertedMidiPath, jsonPath, err = helpers.ConvertToMidi(extractedPaths[0])
+			convertedMidiPath, jsonPath, err = converters.Songs.Convert(c.Request.Context(), extractedPaths[0])
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert file to MIDI"})
 				return
@@ -158,6 +183,21 @@ func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
 				return
 			}
 
+			// Extract the melody, precompute its features, analyze the song and fingerprint WAV
+			// audio. The song can be fixed with the reindex and fingerprint commands on failure
+			if _, err := services.ExtractSongMelody(db, &song); err != nil {
+				fmt.Printf("Failed to extract melody of song %s: %v\n", song.Name, err)
+			}
+			if err := services.IndexSong(db, &song); err != nil {
+				fmt.Printf("Failed to index song %s: %v\n", song.Name, err)
+			}
+			if err := services.AnalyzeSong(db, &song); err != nil {
+				fmt.Printf("Failed to analyze song %s: %v\n", song.Name, err)
+			}
+			if _, err := services.FingerprintSong(db, &song); err != nil && !errors.Is(err, services.ErrNotFingerprintable) {
+				fmt.Printf("Failed to fingerprint song %s: %v\n", song.Name, err)
+			}
+
 			c.JSON(http.StatusOK, gin.H{
 				"message":  "File uploaded and song created successfully",
 				"path":     convertedMidiPath,
@@ -168,11 +208,81 @@ func UploadAndCreateSong(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// SetSongMelodyTrack chooses the track a song's melody is extracted from. A JSON body of
+// {"track": 2} overrides the automatic choice, {"track": null} restores it.
+func SetSongMelodyTrack(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var song models.Song
+		if err := db.First(&song, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return
+		}
+
+		var body struct {
+			Track *int `json:"track"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if body.Track != nil && *body.Track < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "track must not be negative"})
+			return
+		}
+
+		doc, err := services.SetMelodyTrack(db, &song, body.Track)
+		if errors.Is(err, helpers.ErrInvalidMelodyTrack) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update melody track"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Melody track updated",
+			"override":    song.MelodyTrack,
+			"melodyTrack": doc.MelodyTrack,
+			"melodyNotes": len(doc.Melody),
+		})
+	}
+}
+
 // SearchByHumming handles the search functionality for humming or audio file similarity
-func SearchByHumming(db *gorm.DB) gin.HandlerFunc {
+func SearchByHumming(db *gorm.DB, converters helpers.ConverterSet) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		uploadFolder := "hummings"
 
+		// Tuning parameters override the server defaults for this request only
+		params, err := parseMelodyParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Optional pre-filters on the song analysis
+		filters, err := services.ParseSongFilters(formOrQuery(c))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Pick the melody matcher for this request
+		matcher := c.DefaultPostForm("matcher", "histogram")
+		if _, err := services.NewMelodyMatcher(matcher, params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Pick how the humming is transcribed: the native pitch tracker needs no converter
+		// service but only reads WAV, the python service handles every other format
+		converter, err := converters.HummingConverter(c.DefaultPostForm("transcriber", os.Getenv("HUMMING_TRANSCRIBER")))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		// Save the uploaded humming or audio file
 		uploadedFilePaths, err := helpers.SaveUploadedFile(c, "public/uploads", uploadFolder)
 		if err != nil {
@@ -193,93 +303,261 @@ func SearchByHumming(db *gorm.DB) gin.HandlerFunc {
 		audioFilePath := uploadedFilePaths[0]
 
 		// Check if the file needs to be converted to MIDI
-		var jsonHummingPath string
-		_, jsonHummingPath, err = helpers.ConvertToMidi(audioFilePath)
+		midiHummingPath, jsonHummingPath, err := converter.Convert(c.Request.Context(), audioFilePath)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to convert file to MIDI"})
 			return
 		}
 
-		// Fetch all songs from the database
-		var songs []models.Song
-		err = db.Find(&songs).Error
+		// Remove the converted files as well once the search is done
+		defer func() {
+			for _, path := range []string{midiHummingPath, jsonHummingPath} {
+				if path != audioFilePath {
+					os.Remove(path)
+				}
+			}
+		}()
+
+		hummingNotes, err := helpers.LoadNotesFromJSON(jsonHummingPath)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read converted notes"})
+			return
+		}
+
+		// Clean up transcription noise and reject hummings with too little melody to search
+		hummingNotes, _, err = helpers.CleanQuery(hummingNotes, helpers.DefaultQueryCleanupOptions)
+		var rejection *helpers.QueryRejection
+		if errors.As(err, &rejection) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": rejection.Message, "code": rejection.Code, "details": rejection.Details})
+			return
+		}
+
+		respondWithMelodySearch(c, db, hummingNotes, matcher, params, filters)
+	}
+}
+
+// SearchByNotes searches songs by a melody given as notes instead of a recording. The JSON
+// body holds either "pitches", MIDI pitches with optional "durations" in seconds, or "abc",
+// a tune in ABC notation. The matcher and tuning parameters are read as for SearchByHumming.
+func SearchByNotes(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Pitches   []int     `json:"pitches"`
+			Durations []float64 `json:"durations"`
+			ABC       string    `json:"abc"`
+			Matcher   string    `json:"matcher"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		params, err := parseMelodyParams(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch songs"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Channel to collect results from goroutines
-		type MatchResult struct {
-			ID              uint    `json:"ID"`
-			Name            string  `json:"Name"`
-			AudioFilePath   string  `json:"AudioFilePath"`
-			AlbumID         *uint   `json:"AlbumID,omitempty"`
-			SimilarityScore float64 `json:"SimilarityScore"`
+		// Optional pre-filters on the song analysis
+		filters, err := services.ParseSongFilters(formOrQuery(c))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		matcher := body.Matcher
+		if matcher == "" {
+			matcher = c.DefaultQuery("matcher", "histogram")
+		}
+		if _, err := services.NewMelodyMatcher(matcher, params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Build the query notes from exactly one of the two notations
+		var notes []helpers.NoteEvent
+		switch {
+		case len(body.Pitches) > 0 && body.ABC != "":
+			err = errors.New("send either pitches or abc, not both")
+		case len(body.Pitches) > 0:
+			notes, err = helpers.NotesFromPitches(body.Pitches, body.Durations)
+		case body.ABC != "":
+			notes, err = helpers.ParseABC(body.ABC)
+		default:
+			err = errors.New("pitches or abc is required")
+		}
+		if err == nil && len(notes) < 2 {
+			err = errors.New("at least 2 notes are needed to search")
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		respondWithMelodySearch(c, db, notes, matcher, params, filters)
+	}
+}
+
+// SearchByTapping searches songs by rhythm. The JSON body holds "taps", the timestamps of
+// the taps in seconds, which are matched against the note onsets of every song's melody
+// regardless of tempo. min_score and top_k are read as for SearchByHumming.
+func SearchByTapping(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Taps []float64 `json:"taps"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		params, err := parseMelodyParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Optional pre-filters on the song analysis
+		filters, err := services.ParseSongFilters(formOrQuery(c))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(body.Taps) > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at most 500 taps are supported"})
+			return
+		}
+		for _, tap := range body.Taps {
+			if tap < 0 || math.IsNaN(tap) || math.IsInf(tap, 0) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "taps must be non-negative timestamps in seconds"})
+				return
+			}
+		}
+		if intervals := helpers.TapIntervals(body.Taps); len(intervals) < 3 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("only %d distinct taps received, tap at least 4 times", len(intervals)+min(1, len(body.Taps)))})
+			return
 		}
-		resultChan := make(chan MatchResult, len(songs))
 
 		// start benchmarking
 		startTime := time.Now()
 
-		// WaitGroup to wait for all goroutines to finish
-		var wg sync.WaitGroup
-
-		// Calculate similarity between the uploaded MIDI and each song's MIDI concurrently
-		for _, song := range songs {
-			wg.Add(1)
-			go func(song models.Song) {
-				defer wg.Done()
-				// Log checking similarity
-				fmt.Printf("[a]: %s\n[b]: %s\n", jsonHummingPath, song.MidiJSON)
-
-				// Calculate similarity score
-				similarityScore := helpers.CheckAudioSimilarity(jsonHummingPath, song.MidiJSON)
-				if similarityScore > 0.0 {
-					// Send matched song with score to the channel
-					resultChan <- MatchResult{
-						ID:              song.ID,
-						Name:            song.Name,
-						AudioFilePath:   song.AudioFilePath,
-						AlbumID:         song.AlbumID,
-						SimilarityScore: similarityScore,
-					}
-				}
-				fmt.Printf("Checking similarity %s = %f\n", song.Name, similarityScore)
-			}(song)
+		matchedResults, err := services.SearchRhythm(db, body.Taps, params, filters)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search songs"})
+			return
 		}
+		respondWithResults(c, matchedResults, 0, params, startTime)
+	}
+}
+
+// SearchByRecording finds the songs playing in a WAV recording, e.g. a phone held up to a
+// speaker, by their audio fingerprints, and where in each song the recording starts
+func SearchByRecording(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadFolder := "recordings"
 
-		// Wait for all goroutines to complete
-		wg.Wait()
-		close(resultChan)
+		topK, err := parseTopK(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		// Collect results from the channel
-		var matchedResults []MatchResult
-		for result := range resultChan {
-			matchedResults = append(matchedResults, result)
+		// Save the uploaded recording
+		uploadedFilePaths, err := helpers.SaveUploadedFile(c, "public/uploads", uploadFolder)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		// Sort matched results by similarity score in descending order
-		sort.Slice(matchedResults, func(i, j int) bool {
-			return matchedResults[i].SimilarityScore > matchedResults[j].SimilarityScore
-		})
+		// defer delete after
+		defer func() {
+			for _, path := range uploadedFilePaths {
+				os.Remove(path)
+			}
+		}()
 
-		// Limit the result to the top 9 most similar songs
-		if len(matchedResults) > 9 {
-			matchedResults = matchedResults[:9]
+		recordingPath := uploadedFilePaths[0]
+		if !helpers.IsWavFile(recordingPath) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "recordings must be WAV files"})
+			return
 		}
 
-		// Delete the uploaded humming/audio file after comparison
-		err = os.Remove(audioFilePath)
+		prints, err := helpers.FingerprintWavFile(recordingPath, helpers.DefaultFingerprintOptions)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete the uploaded file"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read recording"})
 			return
 		}
+		if len(prints) == 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the recording is too short or too quiet to fingerprint"})
+			return
+		}
+
+		// start benchmarking
+		startTime := time.Now()
 
-		// Respond with the matched songs and their similarity scores
+		matchedResults, err := services.SearchRecording(db, prints, topK)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search songs"})
+			return
+		}
 		if len(matchedResults) > 0 {
-			c.JSON(http.StatusOK, gin.H{"data": matchedResults, "time": time.Since(startTime).Seconds()})
+			c.JSON(http.StatusOK, gin.H{"data": matchedResults, "time": time.Since(startTime).Seconds(), "fingerprints": len(prints)})
 		} else {
-			c.JSON(http.StatusNotFound, gin.H{"message": "No similar songs found"})
+			c.JSON(http.StatusNotFound, gin.H{"message": "No matching songs found", "fingerprints": len(prints)})
+		}
+	}
+}
+
+// respondWithMelodySearch runs a melody search and writes the results, or a 404 when no
+// song is similar enough
+func respondWithMelodySearch(c *gin.Context, db *gorm.DB, query []helpers.NoteEvent, matcher string, params helpers.MelodyParams, filters services.SongFilters) {
+	// start benchmarking
+	startTime := time.Now()
+
+	matchedResults, pruned, err := services.SearchMelody(db, query, matcher, params, filters)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search songs"})
+		return
+	}
+	respondWithResults(c, matchedResults, pruned, params, startTime)
+}
+
+// respondWithResults writes the matched songs and their similarity scores, or a 404 when
+// there are none
+func respondWithResults(c *gin.Context, matchedResults []services.MelodyResult, pruned int, params helpers.MelodyParams, startTime time.Time) {
+	if len(matchedResults) > 0 {
+		c.JSON(http.StatusOK, gin.H{"data": matchedResults, "time": time.Since(startTime).Seconds(), "pruned": pruned, "params": params})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No similar songs found", "pruned": pruned})
+	}
+}
+
+// parseTopK reads top_k alone, with the same default and bounds as parseMelodyParams, for
+// searches that take no other melody parameter
+func parseTopK(c *gin.Context) (int, error) {
+	lookup := formOrQuery(c)
+	params, err := helpers.ParseMelodyParams(helpers.DefaultMelodyParams, func(key string) (string, bool) {
+		if key != "top_k" {
+			return "", false
+		}
+		return lookup(key)
+	})
+	return params.TopK, err
+}
+
+// parseMelodyParams reads the melody tuning parameters from the form body, falling back to
+// the query string, on top of the server defaults
+func parseMelodyParams(c *gin.Context) (helpers.MelodyParams, error) {
+	return helpers.ParseMelodyParams(helpers.DefaultMelodyParams, formOrQuery(c))
+}
+
+// formOrQuery looks a parameter up in the form body first and in the query string second
+func formOrQuery(c *gin.Context) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		if value, ok := c.GetPostForm(key); ok {
+			return value, true
 		}
+		return c.GetQuery(key)
 	}
 }
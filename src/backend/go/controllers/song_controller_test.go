@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"bos/pablo/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// songNotes is the melody every uploaded test song is converted to
+var songNotes = timedNotes(60, 62, 64, 65, 67, 69, 71, 72, 71, 69, 67, 65, 64, 62, 60, 67)
+
+func timedNotes(pitches ...int) []helpers.NoteEvent {
+	notes := make([]helpers.NoteEvent, len(pitches))
+	for i, pitch := range pitches {
+		notes[i] = helpers.NoteEvent{Pitch: pitch, Onset: float64(i) * 0.5, Duration: 0.4, Velocity: 100}
+	}
+	return notes
+}
+
+// setupSongTest gives the test its own database and working directory, since uploads are
+// saved below public/uploads relative to the working directory
+func setupSongTest(t *testing.T) *gorm.DB {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("HUMMING_TRANSCRIBER", "")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	models.AutoMigrateAll(db)
+	return db
+}
+
+// postFile sends fileName as the "file" field of a multipart form, along with fields
+func postFile(t *testing.T, handler gin.HandlerFunc, fileName string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("audio"))
+	form.Close()
+
+	router := gin.New()
+	router.POST("/", handler)
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestUploadAndCreateSong(t *testing.T) {
+	db := setupSongTest(t)
+	songs := &helpers.FakeConverter{Notes: songNotes}
+	humming := &helpers.FakeConverter{Err: errors.New("humming converter used for a song")}
+	converters := helpers.ConverterSet{Songs: songs, Humming: humming, Native: humming, Remote: humming}
+
+	recorder := postFile(t, UploadAndCreateSong(db, converters), "song.mp3", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", recorder.Code, recorder.Body)
+	}
+	if len(songs.Calls) != 1 || !strings.HasSuffix(songs.Calls[0], ".mp3") {
+		t.Fatalf("song converter calls = %v, want the uploaded file", songs.Calls)
+	}
+
+	var song models.Song
+	if err := db.First(&song).Error; err != nil {
+		t.Fatal(err)
+	}
+	if song.AudioFilePath != songs.Calls[0] {
+		t.Fatalf("song audio path = %s, want %s", song.AudioFilePath, songs.Calls[0])
+	}
+	if song.NotesVersion != helpers.NotesFormatVersion {
+		t.Fatalf("song notes version = %d, want %d", song.NotesVersion, helpers.NotesFormatVersion)
+	}
+	if song.NoteCount == nil || *song.NoteCount != len(songNotes) {
+		t.Fatalf("song note count = %v, want %d", song.NoteCount, len(songNotes))
+	}
+	var features int64
+	db.Model(&models.SongFeature{}).Where("song_id = ?", song.ID).Count(&features)
+	if features == 0 {
+		t.Fatal("the song was not indexed")
+	}
+}
+
+func TestUploadAndCreateSongConversionFailure(t *testing.T) {
+	db := setupSongTest(t)
+	failing := &helpers.FakeConverter{Err: errors.New("converter down")}
+
+	recorder := postFile(t, UploadAndCreateSong(db, helpers.ConverterSet{Songs: failing}), "song.mp3", nil)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	var count int64
+	db.Model(&models.Song{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("got %d songs after a failed conversion, want 0", count)
+	}
+}
+
+func TestSearchByHumming(t *testing.T) {
+	db := setupSongTest(t)
+	songs := &helpers.FakeConverter{Notes: songNotes}
+	if recorder := postFile(t, UploadAndCreateSong(db, helpers.ConverterSet{Songs: songs}), "song.mp3", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("upload got status %d: %s", recorder.Code, recorder.Body)
+	}
+	var song models.Song
+	if err := db.First(&song).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The humming is the first half of the song
+	humming := &helpers.FakeConverter{Notes: songNotes[:8]}
+	native := &helpers.FakeConverter{Notes: songNotes[:8]}
+	unused := &helpers.FakeConverter{Err: errors.New("wrong converter")}
+
+	tests := []struct {
+		name       string
+		converters helpers.ConverterSet
+		fields     map[string]string
+		used       *helpers.FakeConverter
+	}{
+		{"default transcriber", helpers.ConverterSet{Humming: humming, Native: unused, Remote: unused}, nil, humming},
+		{"native transcriber", helpers.ConverterSet{Humming: unused, Native: native, Remote: unused}, map[string]string{"transcriber": "native"}, native},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := postFile(t, SearchByHumming(db, test.converters), "humming.wav", test.fields)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", recorder.Code, recorder.Body)
+			}
+			if len(test.used.Calls) != 1 {
+				t.Fatalf("converter calls = %v, want the uploaded humming", test.used.Calls)
+			}
+
+			var response struct {
+				Data []services.MelodyResult `json:"data"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Data) == 0 || response.Data[0].ID != song.ID {
+				t.Fatalf("got results %+v, want song %d first", response.Data, song.ID)
+			}
+		})
+	}
+	if len(unused.Calls) != 0 {
+		t.Fatalf("unselected converters were called with %v", unused.Calls)
+	}
+}
+
+func TestSearchByHummingConversionFailure(t *testing.T) {
+	db := setupSongTest(t)
+	failing := &helpers.FakeConverter{Err: errors.New("converter down")}
+
+	recorder := postFile(t, SearchByHumming(db, helpers.ConverterSet{Humming: failing}), "humming.wav", nil)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
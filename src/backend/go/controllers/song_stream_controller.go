@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/services"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"gorm.io/gorm"
+)
+
+// Limits of a streaming humming search
+const (
+	streamUpdateInterval = 750 * time.Millisecond // how often the query is searched again while it grows
+	streamMaxSeconds     = 60                     // longest audio accepted on one connection
+	streamMaxChunkBytes  = 1 << 20                // largest audio message
+)
+
+// AllowedOrigins are the browser origins allowed to call the API, shared by the CORS
+// middleware and the WebSocket handshake, which CORS does not cover
+var AllowedOrigins = []string{"http://localhost:4000"}
+
+// streamFrame is one message received from the client
+type streamFrame struct {
+	text bool
+	data []byte
+}
+
+// streamFrameCodec receives text and binary messages and keeps their type apart
+var streamFrameCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		frame := v.(*streamFrame)
+		frame.text = payloadType == websocket.TextFrame
+		frame.data = data
+		return nil
+	},
+}
+
+// StreamHummingSearch searches while the user hums. The client streams raw mono audio as
+// binary WebSocket messages, in the format and at the sample rate given in the query string,
+// and sends the text message "stop" when done. The native pitch tracker transcribes the audio
+// as it arrives, and whenever new notes were found the query so far is searched again and the
+// top results are pushed back. The matcher, tuning parameters and filters are read from the
+// query string as for SearchByHumming.
+func StreamHummingSearch(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		params, err := parseMelodyParams(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filters, err := services.ParseSongFilters(c.GetQuery)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		matcher := c.DefaultQuery("matcher", "histogram")
+		if _, err := services.NewMelodyMatcher(matcher, params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sampleRate, err := strconv.Atoi(c.DefaultQuery("sample_rate", strconv.Itoa(helpers.DefaultPitchTrackerOptions.SampleRate)))
+		if err != nil || sampleRate < helpers.MinSampleRate || sampleRate > helpers.MaxSampleRate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("sample_rate must be between %d and %d", helpers.MinSampleRate, helpers.MaxSampleRate)})
+			return
+		}
+
+		format := c.DefaultQuery("format", "pcm16")
+		if _, err := helpers.DecodeStreamChunk(nil, format); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		stream := &hummingStream{
+			db:         db,
+			matcher:    matcher,
+			params:     params,
+			filters:    filters,
+			format:     format,
+			sampleRate: sampleRate,
+			pitch:      helpers.NewPitchStream(sampleRate, helpers.DefaultPitchTrackerOptions),
+		}
+
+		server := websocket.Server{
+			Handshake: checkStreamOrigin,
+			Handler:   stream.serve,
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// checkStreamOrigin accepts browsers on the allowed origins and clients that send no Origin,
+// which are not browsers and so not subject to CORS either
+func checkStreamOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin != "" && !slices.Contains(AllowedOrigins, origin) {
+		return fmt.Errorf("origin %q is not allowed", origin)
+	}
+	return nil
+}
+
+// hummingStream is the state of one streaming humming search
+type hummingStream struct {
+	db         *gorm.DB
+	ws         *websocket.Conn
+	matcher    string
+	params     helpers.MelodyParams
+	filters    services.SongFilters
+	format     string
+	sampleRate int
+
+	mu    sync.Mutex // guards pitch
+	pitch *helpers.PitchStream
+
+	sendMu sync.Mutex // one message is written at a time
+}
+
+func (s *hummingStream) serve(ws *websocket.Conn) {
+	defer ws.Close()
+	s.ws = ws
+	ws.MaxPayloadBytes = streamMaxChunkBytes
+	s.send(gin.H{"type": "ready", "sampleRate": s.sampleRate, "format": s.format})
+
+	// Search again in the background whenever the transcription has grown
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(streamUpdateInterval)
+		defer ticker.Stop()
+		searchedNotes := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				notes, seconds := s.snapshot()
+				if len(notes) != searchedNotes {
+					searchedNotes = len(notes)
+					s.search(notes, seconds, "results")
+				}
+			}
+		}
+	}()
+
+	finished := s.receive()
+	close(done)
+	wg.Wait()
+
+	// A stopped stream gets one last search over the complete humming
+	if finished {
+		notes, seconds := s.snapshot()
+		s.search(notes, seconds, "final")
+	}
+}
+
+// receive feeds audio messages to the pitch tracker until the client stops, which returns
+// true, or the connection fails or sends invalid audio, which returns false
+func (s *hummingStream) receive() bool {
+	for {
+		var frame streamFrame
+		if err := streamFrameCodec.Receive(s.ws, &frame); err != nil {
+			return false
+		}
+
+		if frame.text {
+			if strings.TrimSpace(string(frame.data)) == "stop" {
+				return true
+			}
+			s.send(gin.H{"type": "error", "error": `text messages other than "stop" are not supported`})
+			continue
+		}
+
+		samples, err := helpers.DecodeStreamChunk(frame.data, s.format)
+		if err != nil {
+			s.send(gin.H{"type": "error", "error": err.Error()})
+			return false
+		}
+
+		s.mu.Lock()
+		s.pitch.Write(samples)
+		full := s.pitch.Duration() >= streamMaxSeconds
+		s.mu.Unlock()
+		if full {
+			s.send(gin.H{"type": "error", "error": fmt.Sprintf("streams are limited to %d seconds", streamMaxSeconds)})
+			return true
+		}
+	}
+}
+
+// snapshot returns the notes transcribed so far and the seconds of audio received
+func (s *hummingStream) snapshot() ([]helpers.NoteEvent, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pitch.Notes(), s.pitch.Duration()
+}
+
+// search cleans the query like SearchByHumming and pushes the results as a message of type
+// kind. Queries that are still too short are answered with a "listening" message.
+func (s *hummingStream) search(notes []helpers.NoteEvent, seconds float64, kind string) {
+	cleaned, _, err := helpers.CleanQuery(notes, helpers.DefaultQueryCleanupOptions)
+	var rejection *helpers.QueryRejection
+	if errors.As(err, &rejection) {
+		s.send(gin.H{"type": "listening", "seconds": seconds, "notes": len(cleaned), "code": rejection.Code, "message": rejection.Message})
+		return
+	}
+
+	startTime := time.Now()
+	results, pruned, err := services.SearchMelody(s.db, cleaned, s.matcher, s.params, s.filters)
+	if err != nil {
+		s.send(gin.H{"type": "error", "error": "Failed to search songs"})
+		return
+	}
+	s.send(gin.H{
+		"type":    kind,
+		"seconds": seconds,
+		"notes":   len(cleaned),
+		"data":    results,
+		"pruned":  pruned,
+		"time":    time.Since(startTime).Seconds(),
+	})
+}
+
+func (s *hummingStream) send(message gin.H) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := websocket.JSON.Send(s.ws, message); err != nil {
+		log.Println("Failed to send stream message:", err)
+	}
+}
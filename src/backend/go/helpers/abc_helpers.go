@@ -0,0 +1,460 @@
+// abc_helpers.go contains a parser for single-voice ABC notation tunes, used by symbolic melody queries
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// abcLetters maps note letters to their semitone above C and their index in the key signature
+var abcLetters = map[rune]struct{ semitone, index int }{
+	'C': {0, 0}, 'D': {2, 1}, 'E': {4, 2}, 'F': {5, 3}, 'G': {7, 4}, 'A': {9, 5}, 'B': {11, 6},
+}
+
+// abcSharpOrder and abcFlatOrder list the key signature letters in the order accidentals are added
+const (
+	abcSharpOrder = "FCGDAEB"
+	abcFlatOrder  = "BEADGCF"
+)
+
+// abcModes maps mode names to their offset in fifths from the major mode of the same tonic
+var abcModes = map[string]int{
+	"": 0, "maj": 0, "ion": 0, "m": -3, "min": -3, "aeo": -3,
+	"mix": -1, "dor": -2, "phr": -4, "loc": -5, "lyd": 1,
+}
+
+// abcItem is a parsed note or rest, with its length in whole notes
+type abcItem struct {
+	pitch  int // -1 for rests
+	length float64
+	tie    bool
+}
+
+type abcParser struct {
+	unitLength     float64 // L: field, in whole notes
+	meterLength    float64 // M: field, in whole notes, for multi-measure rests
+	tempoBeat      float64 // Q: field beat in whole notes, 0 for the unit length
+	tempoBPM       float64
+	keyAccidentals [7]int
+	barAccidentals map[int]int // accidental of every natural pitch altered in the current bar
+
+	items        []abcItem
+	brokenFactor float64 // length factor of the next note after a broken rhythm
+	tupletLeft   int
+	tupletFactor float64
+}
+
+// ParseABC parses the first tune of an ABC notation string into timed note events.
+// Supported are the L:, M:, Q: and K: fields, accidentals, octave marks, note lengths,
+// rests, ties, broken rhythms, tuplets and chords, of which the top note is kept.
+// Grace notes, decorations, chord symbols and lyrics are skipped.
+func ParseABC(source string) ([]NoteEvent, error) {
+	p := &abcParser{
+		unitLength:     1.0 / 8,
+		meterLength:    1,
+		tempoBPM:       120,
+		tempoBeat:      1.0 / 4,
+		barAccidentals: map[int]int{},
+		brokenFactor:   1,
+	}
+
+	inBody := false
+	for _, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		if index := strings.Index(line, "%"); index >= 0 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// Field lines look like "K:G"
+		if len(line) >= 2 && line[1] == ':' && unicode.IsLetter(rune(line[0])) {
+			if line[0] == 'X' && len(p.items) > 0 {
+				break // start of the next tune
+			}
+			if err := p.field(line[0], strings.TrimSpace(line[2:])); err != nil {
+				return nil, err
+			}
+			if line[0] == 'K' {
+				inBody = true
+			}
+			continue
+		}
+		// Without a K: field the whole input is treated as tune body
+		inBody = true
+		if err := p.body(line); err != nil {
+			return nil, err
+		}
+	}
+	if !inBody || len(p.items) == 0 {
+		return nil, errors.New("ABC tune has no notes")
+	}
+	return p.notes(), nil
+}
+
+// field applies a header or inline field
+func (p *abcParser) field(name byte, value string) error {
+	switch name {
+	case 'L':
+		length, err := parseABCFraction(value)
+		if err != nil {
+			return fmt.Errorf("invalid L: field %q", value)
+		}
+		p.unitLength = length
+	case 'M':
+		switch value {
+		case "C", "C|":
+			p.meterLength = 1
+		case "", "none":
+		default:
+			length, err := parseABCFraction(value)
+			if err != nil {
+				return fmt.Errorf("invalid M: field %q", value)
+			}
+			p.meterLength = length
+		}
+	case 'Q':
+		// Either "1/4=120" or a bare beats per minute count of the unit length
+		beat, bpm := "", value
+		if index := strings.Index(value, "="); index >= 0 {
+			beat, bpm = strings.TrimSpace(value[:index]), strings.TrimSpace(value[index+1:])
+		}
+		// Tempo text such as "Allegro" may surround the value in quotes
+		bpm = strings.Trim(strings.TrimSpace(bpm), "\"")
+		tempo, err := strconv.ParseFloat(strings.TrimSpace(strings.SplitN(bpm, " ", 2)[0]), 64)
+		if err != nil || tempo <= 0 {
+			return fmt.Errorf("invalid Q: field %q", value)
+		}
+		p.tempoBPM, p.tempoBeat = tempo, 0
+		if beat != "" {
+			if p.tempoBeat, err = parseABCFraction(strings.SplitN(beat, " ", 2)[0]); err != nil {
+				return fmt.Errorf("invalid Q: field %q", value)
+			}
+		}
+	case 'K':
+		fifths, err := parseABCKey(value)
+		if err != nil {
+			return err
+		}
+		p.keyAccidentals = [7]int{}
+		for i := 0; i < fifths && i < 7; i++ {
+			p.keyAccidentals[abcLetters[rune(abcSharpOrder[i])].index] = 1
+		}
+		for i := 0; i < -fifths && i < 7; i++ {
+			p.keyAccidentals[abcLetters[rune(abcFlatOrder[i])].index] = -1
+		}
+	}
+	return nil
+}
+
+// body parses one line of tune body
+func (p *abcParser) body(line string) error {
+	s := []rune(line)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '|' || c == ':':
+			p.barAccidentals = map[int]int{}
+			i++
+			// Skip repeat endings such as |1 and :|2
+			for i < len(s) && unicode.IsDigit(s[i]) {
+				i++
+			}
+
+		case c == '"':
+			i = skipABCUntil(s, i+1, '"')
+		case c == '!' || c == '+':
+			i = skipABCUntil(s, i+1, c)
+		case c == '{':
+			i = skipABCUntil(s, i+1, '}')
+
+		case c == '(' && i+1 < len(s) && unicode.IsDigit(s[i+1]):
+			count := int(s[i+1] - '0')
+			inTimeOf := 2
+			if count == 2 || count == 4 || count == 8 {
+				inTimeOf = 3
+			}
+			i += 2
+			if i+1 < len(s) && s[i] == ':' && unicode.IsDigit(s[i+1]) {
+				inTimeOf = int(s[i+1] - '0')
+				i += 2
+			}
+			p.tupletLeft, p.tupletFactor = count, float64(inTimeOf)/float64(count)
+
+		case c == '[' && i+2 < len(s) && unicode.IsLetter(s[i+1]) && s[i+2] == ':':
+			end := i + 3
+			for end < len(s) && s[end] != ']' {
+				end++
+			}
+			if end == len(s) {
+				return fmt.Errorf("unterminated inline field %q", string(s[i:]))
+			}
+			if err := p.field(byte(s[i+1]), strings.TrimSpace(string(s[i+3:end]))); err != nil {
+				return err
+			}
+			i = end + 1
+
+		case c == '[':
+			// Chord, keep the highest note
+			i++
+			top, length, found := -1, 0.0, false
+			for i < len(s) && s[i] != ']' {
+				pitch, noteLength, next, ok := p.note(s, i)
+				if !ok {
+					i++
+					continue
+				}
+				if !found {
+					length, found = noteLength, true
+				}
+				top = max(top, pitch)
+				i = next
+			}
+			i++
+			multiplier, next := parseABCLength(s, i)
+			i = next
+			if found {
+				p.add(top, length*multiplier)
+			}
+
+		case c == 'z' || c == 'x':
+			multiplier, next := parseABCLength(s, i+1)
+			p.add(-1, p.unitLength*multiplier)
+			i = next
+		case c == 'Z' || c == 'X':
+			multiplier, next := parseABCLength(s, i+1)
+			p.add(-1, p.meterLength*multiplier)
+			i = next
+
+		case c == '-':
+			if n := len(p.items); n > 0 {
+				p.items[n-1].tie = true
+			}
+			i++
+
+		case c == '>' || c == '<':
+			count := 0
+			for i < len(s) && s[i] == c {
+				count++
+				i++
+			}
+			// ABC defines broken rhythm up to three markers, >>> being 15/8 and 1/8
+			if count > 3 {
+				return fmt.Errorf("broken rhythm with %d markers, at most 3 are allowed", count)
+			}
+			short := 1 / float64(int(1)<<count)
+			long := 2 - short
+			if c == '<' {
+				short, long = long, short
+			}
+			if n := len(p.items); n > 0 {
+				p.items[n-1].length *= long
+			}
+			p.brokenFactor = short
+
+		default:
+			pitch, length, next, ok := p.note(s, i)
+			if !ok {
+				i++
+				continue
+			}
+			p.add(pitch, length)
+			i = next
+		}
+	}
+	return nil
+}
+
+// note parses a note with its accidentals, octave marks and length starting at s[i]
+func (p *abcParser) note(s []rune, i int) (int, float64, int, bool) {
+	accidental, explicit := 0, false
+	for i < len(s) && (s[i] == '^' || s[i] == '_' || s[i] == '=') {
+		switch s[i] {
+		case '^':
+			accidental++
+		case '_':
+			accidental--
+		}
+		explicit = true
+		i++
+	}
+	if i >= len(s) {
+		return 0, 0, i, false
+	}
+
+	letter, ok := abcLetters[unicode.ToUpper(s[i])]
+	if !ok {
+		return 0, 0, i, false
+	}
+	natural := 60 + letter.semitone
+	if unicode.IsLower(s[i]) {
+		natural += 12
+	}
+	i++
+	for i < len(s) && (s[i] == '\'' || s[i] == ',') {
+		if s[i] == '\'' {
+			natural += 12
+		} else {
+			natural -= 12
+		}
+		i++
+	}
+
+	// Accidentals last until the end of the bar
+	if explicit {
+		p.barAccidentals[natural] = accidental
+	} else if barAccidental, ok := p.barAccidentals[natural]; ok {
+		accidental = barAccidental
+	} else {
+		accidental = p.keyAccidentals[letter.index]
+	}
+
+	multiplier, next := parseABCLength(s, i)
+	return natural + accidental, p.unitLength * multiplier, next, true
+}
+
+// add appends a note or rest, applying pending broken rhythm and tuplet factors
+func (p *abcParser) add(pitch int, length float64) {
+	length *= p.brokenFactor
+	p.brokenFactor = 1
+	if p.tupletLeft > 0 {
+		length *= p.tupletFactor
+		p.tupletLeft--
+	}
+	p.items = append(p.items, abcItem{pitch: pitch, length: length})
+}
+
+// notes converts the parsed items into note events, merging tied notes
+func (p *abcParser) notes() []NoteEvent {
+	beat := p.tempoBeat
+	if beat == 0 {
+		beat = p.unitLength
+	}
+	secondsPerWhole := 60 / (p.tempoBPM * beat)
+
+	notes := []NoteEvent{}
+	position := 0.0
+	tied := false
+	for _, item := range p.items {
+		duration := item.length * secondsPerWhole
+		if item.pitch >= 0 {
+			if n := len(notes); tied && n > 0 && notes[n-1].Pitch == item.pitch {
+				notes[n-1].Duration += duration
+			} else {
+				notes = append(notes, NoteEvent{
+					Pitch:    max(0, min(127, item.pitch)),
+					Onset:    position,
+					Duration: duration,
+					Velocity: 80,
+				})
+			}
+		}
+		tied = item.tie
+		position += duration
+	}
+	return notes
+}
+
+// parseABCLength parses an optional length multiplier such as 2, 3/2, / or //
+func parseABCLength(s []rune, i int) (float64, int) {
+	numerator, denominator := 0, 0
+	for i < len(s) && unicode.IsDigit(s[i]) {
+		numerator = numerator*10 + int(s[i]-'0')
+		i++
+	}
+	if numerator == 0 {
+		numerator = 1
+	}
+
+	slashes := 0
+	for i < len(s) && s[i] == '/' {
+		slashes++
+		i++
+	}
+	for i < len(s) && unicode.IsDigit(s[i]) {
+		denominator = denominator*10 + int(s[i]-'0')
+		i++
+	}
+	switch {
+	case slashes == 0:
+		denominator = 1
+	case denominator == 0:
+		denominator = 1 << slashes
+	}
+	return float64(numerator) / float64(denominator), i
+}
+
+// parseABCFraction parses a field value such as 1/8 or 6/8
+func parseABCFraction(value string) (float64, error) {
+	parts := strings.SplitN(value, "/", 2)
+	numerator, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, err
+	}
+	denominator := 1
+	if len(parts) == 2 {
+		if denominator, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, err
+		}
+	}
+	if numerator <= 0 || denominator <= 0 {
+		return 0, errors.New("fraction must be positive")
+	}
+	return float64(numerator) / float64(denominator), nil
+}
+
+// parseABCKey returns the number of sharps (positive) or flats (negative) of a K: field
+func parseABCKey(value string) (int, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || fields[0] == "none" || fields[0] == "HP" || fields[0] == "Hp" {
+		return 0, nil
+	}
+	key := fields[0]
+
+	letter, ok := abcLetters[unicode.ToUpper(rune(key[0]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid K: field %q", value)
+	}
+	// Fifths of the major key on the natural tonic: F=-1, C=0, G=1 ... B=5
+	fifths := map[int]int{0: 0, 1: 2, 2: 4, 3: -1, 4: 1, 5: 3, 6: 5}[letter.index]
+	rest := key[1:]
+	if strings.HasPrefix(rest, "#") {
+		fifths += 7
+		rest = rest[1:]
+	} else if strings.HasPrefix(rest, "b") {
+		fifths -= 7
+		rest = rest[1:]
+	}
+
+	// The mode may follow the tonic directly or as the next word, which may also be a clef
+	if offset, ok := abcModes[abcModeName(rest)]; ok {
+		if rest == "" && len(fields) > 1 {
+			if nextOffset, ok := abcModes[abcModeName(fields[1])]; ok {
+				offset = nextOffset
+			}
+		}
+		return fifths + offset, nil
+	}
+	return 0, fmt.Errorf("unknown mode in K: field %q", value)
+}
+
+// abcModeName shortens a mode such as "Dorian" to the three letters used as its key
+func abcModeName(mode string) string {
+	mode = strings.ToLower(mode)
+	if len(mode) > 3 {
+		mode = mode[:3]
+	}
+	return mode
+}
+
+// skipABCUntil returns the index after the next closing rune, or the end of the line
+func skipABCUntil(s []rune, i int, closing rune) int {
+	for i < len(s) && s[i] != closing {
+		i++
+	}
+	return min(i+1, len(s))
+}
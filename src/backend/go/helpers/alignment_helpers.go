@@ -0,0 +1,226 @@
+// alignment_helpers.go contains a Mongeau-Sankoff style edit distance matcher over melody interval sequences
+package helpers
+
+import (
+	"math"
+)
+
+// AlignmentOptions controls the interval alignment matcher
+type AlignmentOptions struct {
+	PitchWeight      float64 // weight of the interval size difference in a substitution
+	DurationWeight   float64 // weight of the log2 duration difference in a substitution
+	MaxIntervalCost  int     // interval differences are capped at this many semitones
+	GapCost          float64 // cost of inserting or deleting one interval
+	MaxFragment      int     // most intervals one interval may be split into or merged from
+	FragmentPenalty  float64 // extra cost per additional interval of a fragmentation or consolidation
+	OctaveEquivalent bool    // intervals differing by whole octaves substitute like a semitone
+}
+
+// DefaultAlignmentOptions are the options used when a request does not override them
+var DefaultAlignmentOptions = AlignmentOptions{
+	PitchWeight:      0.75,
+	DurationWeight:   0.25,
+	MaxIntervalCost:  6,
+	GapCost:          0.6,
+	MaxFragment:      3,
+	FragmentPenalty:  0.15,
+	OctaveEquivalent: true,
+}
+
+// Edit operations of an alignment
+const (
+	AlignMatch       = "match"       // one interval against an identical one
+	AlignSubstitute  = "substitute"  // one interval against a different one
+	AlignInsert      = "insert"      // a song interval the query skips
+	AlignDelete      = "delete"      // a query interval the song does not have
+	AlignFragment    = "fragment"    // one query interval against several song intervals
+	AlignConsolidate = "consolidate" // several query intervals against one song interval
+)
+
+// AlignmentStep is one operation of an alignment path. Interval i joins note i and note i+1,
+// so Query and Song are [start, end) interval ranges, empty for insertions and deletions.
+type AlignmentStep struct {
+	Op    string  `json:"Op"`
+	Query [2]int  `json:"Query"`
+	Song  [2]int  `json:"Song"`
+	Cost  float64 `json:"Cost"`
+}
+
+// alignmentInterval is one melodic interval and the relative duration of the note it leads to
+type alignmentInterval struct {
+	semitones int
+	duration  float64 // relative to the median note duration, 0 without timing
+}
+
+// alignmentOps indexes the edit operations so a matrix cell stays small
+var alignmentOps = []string{AlignMatch, AlignSubstitute, AlignInsert, AlignDelete, AlignFragment, AlignConsolidate}
+
+const (
+	opMatch uint8 = iota
+	opSubstitute
+	opInsert
+	opDelete
+	opFragment
+	opConsolidate
+)
+
+// alignmentCell is one cell of the alignment matrix and the move that reached it
+type alignmentCell struct {
+	cost       float64
+	stepCost   float64
+	op         uint8
+	queryCount uint8
+	songCount  uint8
+}
+
+// MatchMelodyAlignment aligns the intervals of the whole query against the best stretch of
+// the song's intervals. Unlike the histograms it respects note order, and intervals make it
+// transposition invariant. Besides substitutions, insertions and deletions, one interval may
+// be aligned with up to opts.MaxFragment intervals on the other side whose sum it equals, as
+// when a held note is sung as several or a run is sung as one. The score is 1 minus the mean
+// cost per query interval, and the alignment path is returned with the match.
+func MatchMelodyAlignment(query, song []NoteEvent, opts AlignmentOptions) MelodyMatch {
+	useDuration := opts.DurationWeight > 0 && HasTiming(query) && HasTiming(song)
+	queryIntervals := alignmentIntervals(query, useDuration)
+	songIntervals := alignmentIntervals(song, useDuration)
+	n, m := len(queryIntervals), len(songIntervals)
+	if n == 0 || m == 0 {
+		return MelodyMatch{}
+	}
+	maxFragment := max(1, min(opts.MaxFragment, 8))
+
+	// The query must be aligned completely, the song may start and end anywhere
+	cells := make([][]alignmentCell, n+1)
+	for i := range cells {
+		cells[i] = make([]alignmentCell, m+1)
+	}
+	for i := 1; i <= n; i++ {
+		cells[i][0] = alignmentCell{cost: cells[i-1][0].cost + opts.GapCost, op: opDelete, queryCount: 1, stepCost: opts.GapCost}
+	}
+
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			best := alignmentCell{cost: cells[i-1][j].cost + opts.GapCost, op: opDelete, queryCount: 1, stepCost: opts.GapCost}
+			consider := func(candidate alignmentCell) {
+				if candidate.cost < best.cost {
+					best = candidate
+				}
+			}
+			consider(alignmentCell{cost: cells[i][j-1].cost + opts.GapCost, op: opInsert, songCount: 1, stepCost: opts.GapCost})
+
+			for k := 1; k <= maxFragment && k <= i; k++ {
+				for l := 1; l <= maxFragment && l <= j; l++ {
+					// Fragmentation and consolidation are one to many, never many to many
+					if k > 1 && l > 1 {
+						continue
+					}
+					cost := substitutionCost(queryIntervals[i-k:i], songIntervals[j-l:j], opts)
+					cost += opts.FragmentPenalty * float64(k+l-2)
+
+					op := opSubstitute
+					switch {
+					case k > 1:
+						op = opConsolidate
+					case l > 1:
+						op = opFragment
+					case cost == 0:
+						op = opMatch
+					}
+					consider(alignmentCell{cost: cells[i-k][j-l].cost + cost, op: op, queryCount: uint8(k), songCount: uint8(l), stepCost: cost})
+				}
+			}
+			cells[i][j] = best
+		}
+	}
+
+	bestEnd := 0
+	for j := 1; j <= m; j++ {
+		if cells[n][j].cost < cells[n][bestEnd].cost {
+			bestEnd = j
+		}
+	}
+
+	// Trace the path back to the first query interval
+	var path []AlignmentStep
+	counts := map[string]float64{}
+	i, j := n, bestEnd
+	for i > 0 {
+		cell := cells[i][j]
+		queryCount, songCount := int(cell.queryCount), int(cell.songCount)
+		path = append(path, AlignmentStep{
+			Op:    alignmentOps[cell.op],
+			Query: [2]int{i - queryCount, i},
+			Song:  [2]int{j - songCount, j},
+			Cost:  cell.stepCost,
+		})
+		counts[alignmentOps[cell.op]]++
+		i, j = i-queryCount, j-songCount
+	}
+	for left, right := 0, len(path)-1; left < right; left, right = left+1, right-1 {
+		path[left], path[right] = path[right], path[left]
+	}
+
+	distance := cells[n][bestEnd].cost / float64(n)
+	features := map[string]float64{"distance": distance}
+	for _, op := range []string{AlignInsert, AlignDelete, AlignFragment, AlignConsolidate} {
+		features[op+"s"] = counts[op]
+	}
+
+	// Intervals j..bestEnd span notes j..bestEnd inclusive
+	match := newMelodyMatch(math.Max(0, 1-distance), features, song, j, bestEnd+1, HasTiming(song))
+	match.Alignment = path
+	return match
+}
+
+// alignmentIntervals turns notes into the intervals between consecutive notes. With timing
+// each interval carries the duration of the note it leads to, relative to the median duration.
+func alignmentIntervals(notes []NoteEvent, useDuration bool) []alignmentInterval {
+	if len(notes) < 2 {
+		return nil
+	}
+
+	var durations []float64
+	for _, note := range notes {
+		if note.Duration > 0 {
+			durations = append(durations, note.Duration)
+		}
+	}
+	center := median(durations)
+
+	intervals := make([]alignmentInterval, len(notes)-1)
+	for i := range intervals {
+		intervals[i].semitones = notes[i+1].Pitch - notes[i].Pitch
+		if useDuration && center > 0 {
+			intervals[i].duration = notes[i+1].Duration / center
+		}
+	}
+	return intervals
+}
+
+// substitutionCost compares the combined intervals of a and b. Consecutive intervals add up
+// to the interval from the first to the last note and their durations add up too, which lets
+// the same cost serve fragmentation and consolidation.
+func substitutionCost(a, b []alignmentInterval, opts AlignmentOptions) float64 {
+	var semitonesA, semitonesB int
+	var durationA, durationB float64
+	for _, interval := range a {
+		semitonesA += interval.semitones
+		durationA += interval.duration
+	}
+	for _, interval := range b {
+		semitonesB += interval.semitones
+		durationB += interval.duration
+	}
+
+	maxIntervalCost := max(1, opts.MaxIntervalCost)
+	difference := abs(semitonesA - semitonesB)
+	if opts.OctaveEquivalent && difference > 0 && difference%12 == 0 {
+		difference = 1
+	}
+	cost := opts.PitchWeight * float64(min(difference, maxIntervalCost)) / float64(maxIntervalCost)
+
+	if durationA > 0 && durationB > 0 {
+		cost += opts.DurationWeight * math.Min(math.Abs(math.Log2(durationA/durationB)), 2) / 2
+	}
+	return cost
+}
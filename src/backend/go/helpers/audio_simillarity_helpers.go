@@ -1,81 +1,40 @@
 package helpers
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"math"
 )
 
-func LoadNotesArrayFromJSON(filePath string) ([]int, error) {
-	fileData, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, err
-	}
-
-	var notes []int
-
-	err = json.Unmarshal(fileData, &notes)
-	if err != nil {
-		return nil, err
-	}
+// rhythmWeight is the share of the final score given to the inter-onset rhythm histogram
+// when both melodies carry timing
+const rhythmWeight = 0.2
 
-	return notes, nil
-}
-
-func normalizePitch(notes []int) []float64 {
-	var mean, stdDev float64
-	for _, note := range notes {
-		mean += float64(note)
-	}
-	mean /= float64(len(notes))
-
-	for _, note := range notes {
-		stdDev += math.Pow(float64(note)-mean, 2)
-	}
-	stdDev = math.Sqrt(stdDev / float64(len(notes)))
-
-	normalized := make([]float64, len(notes))
-	for i, note := range notes {
-		normalized[i] = (float64(note) - mean) / stdDev
-	}
-	return normalized
-}
+// Histogram sizes
+const (
+	atbBins = 128 // absolute pitches
+	rtbBins = 255 // intervals between consecutive notes, -127 to 127
+	ftbBins = 255 // intervals from the first note, -127 to 127
+	ioiBins = 25  // inter-onset interval ratios
+)
 
 func computeATB(notes []int) []float64 {
-	atb := make([]float64, 128)
+	atb := make([]float64, atbBins)
 	for _, note := range notes {
 		atb[note]++
 	}
-
-	// total := 0.0
-	// for _, count := range atb {
-	// 	total += count
-	// }
-	// for i := range atb {
-	// 	atb[i] /= total
-	// }
 	return atb
 }
 
 func computeRTB(notes []int) []float64 {
-	rtb := make([]float64, 255)
+	rtb := make([]float64, rtbBins)
 	for i := 1; i < len(notes); i++ {
 		diff := notes[i] - notes[i-1] + 127
 		rtb[diff]++
 	}
-
-	// total := 0.0
-	// for _, count := range rtb {
-	// 	total += count
-	// }
-	// for i := range rtb {
-	// 	rtb[i] /= total
-	// }
 	return rtb
 }
 
 func computeFTB(notes []int) []float64 {
-	ftb := make([]float64, 255)
+	ftb := make([]float64, ftbBins)
 	if len(notes) == 0 {
 		return ftb
 	}
@@ -85,17 +44,28 @@ func computeFTB(notes []int) []float64 {
 		diff := note - first + 127
 		ftb[diff]++
 	}
-
-	// total := 0.0
-	// for _, count := range ftb {
-	// 	total += count
-	// }
-	// for i := range ftb {
-	// 	ftb[i] /= total
-	// }
 	return ftb
 }
 
+// computeIOIHistogram buckets the ratios between consecutive inter-onset intervals on a
+// quarter-octave log scale, which makes it independent of tempo
+func computeIOIHistogram(notes []NoteEvent) []float64 {
+	ioi := make([]float64, ioiBins)
+	var intervals []float64
+	for i := 1; i < len(notes); i++ {
+		if gap := notes[i].Onset - notes[i-1].Onset; gap > 0.01 {
+			intervals = append(intervals, gap)
+		}
+	}
+
+	for i := 1; i < len(intervals); i++ {
+		bucket := int(math.Round(4*math.Log2(intervals[i]/intervals[i-1]))) + 12
+		bucket = int(math.Max(0, math.Min(24, float64(bucket))))
+		ioi[bucket]++
+	}
+	return ioi
+}
+
 func cosineSimilarity(vec1, vec2 []float64) float64 {
 	if len(vec1) != len(vec2) {
 		panic("Vectors must have the same length")
@@ -115,79 +85,157 @@ func cosineSimilarity(vec1, vec2 []float64) float64 {
 	return dotProduct / (math.Sqrt(normA) * math.Sqrt(normB))
 }
 
-func CheckAudioSimilarity(hummingAudioPathMidi, songAudioPathMidi string) float64 {
-	hummingNotes, err := LoadNotesArrayFromJSON(hummingAudioPathMidi)
-	if err != nil {
-		return -1
+// normalizeHistogram scales a histogram in place so its bins sum to 1
+func normalizeHistogram(histogram []float64) []float64 {
+	total := 0.0
+	for _, count := range histogram {
+		total += count
 	}
-
-	songNotes, err := LoadNotesArrayFromJSON(songAudioPathMidi)
-	if err != nil {
-		return -1
+	if total == 0 {
+		return histogram
 	}
-
-	// for i := 0; i < len(songNotes); i++ {
-	// 	fmt.Print(songNotes[i])
-	// 	fmt.Print(" ")
-	// }
-	// fmt.Println()
-
-	// for i := 0; i < len(hummingNotes); i++ {
-	// 	fmt.Print(hummingNotes[i])
-	// 	fmt.Print(" ")
-	// }
-	// fmt.Println()
-
-	hummingATB := computeATB(hummingNotes)
-	hummingRTB := computeRTB(hummingNotes)
-	hummingFTB := computeFTB(hummingNotes)
-
-	if len(songNotes) <= len(hummingNotes) {
-		songATB := computeATB(songNotes)
-		songRTB := computeRTB(songNotes)
-		songFTB := computeFTB(songNotes)
-
-		atbSim := cosineSimilarity(hummingATB, songATB)
-		rtbSim := cosineSimilarity(hummingRTB, songRTB)
-		ftbSim := cosineSimilarity(hummingFTB, songFTB)
-
-		return 0.05*atbSim + 0.55*rtbSim + 0.40*ftbSim
+	for i := range histogram {
+		histogram[i] /= total
 	}
+	return histogram
+}
 
-	windowSize := len(hummingNotes)
+// MelodyMatch explains where and how well a query matched inside a song. Every matcher
+// aligns the whole query, so only the song side of the match has a range.
+type MelodyMatch struct {
+	Score         float64            `json:"Score"`
+	Offset        int                `json:"Offset"`                  // first song note of the best match
+	OffsetSeconds *float64           `json:"OffsetSeconds,omitempty"` // nil when the song has no timing
+	Features      map[string]float64 `json:"Features"`                // per-feature scores of the best match
+	SongRange     [2]int             `json:"SongRange"`               // aligned song notes, [start, end)
+	Alignment     []AlignmentStep    `json:"Alignment,omitempty"`     // edit path of the alignment matcher
+}
 
-	songATB := computeATB(songNotes[0:windowSize])
-	songRTB := computeRTB(songNotes[0:windowSize])
-	songFTB := computeFTB(songNotes[0:windowSize])
+// newMelodyMatch fills in the range and the offset in seconds of a match of the whole query
+// against song[start:end]
+func newMelodyMatch(score float64, features map[string]float64, song []NoteEvent, start, end int, timed bool) MelodyMatch {
+	match := MelodyMatch{
+		Score:     score,
+		Offset:    start,
+		Features:  features,
+		SongRange: [2]int{start, end},
+	}
+	if timed && start < len(song) {
+		onset := song[start].Onset
+		match.OffsetSeconds = &onset
+	}
+	return match
+}
 
-	atbSim := cosineSimilarity(hummingATB, songATB)
-	rtbSim := cosineSimilarity(hummingRTB, songRTB)
-	ftbSim := cosineSimilarity(hummingFTB, songFTB)
+// MatchMelodyHistogram slides windows sized by params.WindowMultipliers over the song every
+// params.WindowStep notes and keeps the window whose ATB/RTB/FTB histograms are most similar
+func MatchMelodyHistogram(hummingEvents, songEvents []NoteEvent, params MelodyParams) MelodyMatch {
+	if len(hummingEvents) == 0 || len(songEvents) == 0 {
+		return MelodyMatch{}
+	}
 
-	maxSimilarity := 0.05*atbSim + 0.55*rtbSim + 0.40*ftbSim
+	songTimed := HasTiming(songEvents)
 
-	for it := windowSize; it < len(songNotes); it++ {
+	// Rhythm only contributes when both sides know when their notes start
+	useRhythm := HasTiming(hummingEvents) && songTimed
+	var hummingIOI []float64
+	if useRhythm {
+		hummingIOI = computeIOIHistogram(hummingEvents)
+	}
 
-		songATB[songNotes[it-windowSize]]--
-		songATB[songNotes[it]]++
+	hummingNotes := Pitches(hummingEvents)
+	hummingATB, hummingRTB, hummingFTB := computeATB(hummingNotes), computeRTB(hummingNotes), computeFTB(hummingNotes)
+	if params.Normalize {
+		normalizeHistogram(hummingATB)
+		normalizeHistogram(hummingRTB)
+		normalizeHistogram(hummingFTB)
+	}
+	songNotes := Pitches(songEvents)
+	compare := params.similarityMetric().Similarity
 
-		songRTB[songNotes[it-windowSize+1]-songNotes[it-windowSize]+127]--
-		songRTB[songNotes[it]-songNotes[it-1]+127]++
+	score := func(window *windowHistograms) MelodyMatch {
+		songATB, songRTB, songFTB := window.histograms(params.Normalize)
+		features := map[string]float64{
+			"atb": compare(hummingATB, songATB),
+			"rtb": compare(hummingRTB, songRTB),
+			"ftb": compare(hummingFTB, songFTB),
+		}
+		similarity := params.Weights.combine(features["atb"], features["rtb"], features["ftb"])
+		if useRhythm {
+			features["rhythm"] = compare(hummingIOI, computeIOIHistogram(songEvents[window.start:window.end]))
+			similarity = (1-rhythmWeight)*similarity + rhythmWeight*features["rhythm"]
+		}
+		return newMelodyMatch(similarity, features, songEvents, window.start, window.end, songTimed)
+	}
+
+	var best MelodyMatch
+	found := false
+	for _, windowSize := range params.WindowSizes(len(hummingEvents)) {
+		windowSize = min(windowSize, len(songNotes))
+		window := newWindowHistograms(songNotes, windowSize)
+		for {
+			if match := score(window); !found || match.Score > best.Score {
+				best, found = match, true
+			}
+			if window.end+params.WindowStep > len(songNotes) {
+				break
+			}
+			for step := 0; step < params.WindowStep; step++ {
+				window.slide()
+			}
+		}
+	}
+	return best
+}
 
-		songFTB[songNotes[it-windowSize]-songNotes[0]+127]--
-		songFTB[songNotes[it]-songNotes[0]+127]--
+// windowHistograms keeps the ATB and RTB counts of a window sliding over notes, updated as
+// notes enter and leave it rather than recounted for every window. The FTB is the ATB
+// shifted so the window's first note lands on the middle bin.
+type windowHistograms struct {
+	notes      []int
+	start, end int
+	atb, rtb   []float64
+	ftb        []float64 // scratch for histograms
+}
 
-		atbSim := cosineSimilarity(hummingATB, songATB)
-		rtbSim := cosineSimilarity(hummingRTB, songRTB)
-		ftbSim := cosineSimilarity(hummingFTB, songFTB)
+func newWindowHistograms(notes []int, size int) *windowHistograms {
+	return &windowHistograms{
+		notes: notes,
+		end:   size,
+		atb:   computeATB(notes[:size]),
+		rtb:   computeRTB(notes[:size]),
+		ftb:   make([]float64, ftbBins),
+	}
+}
 
-		similarity := 0.05*atbSim + 0.55*rtbSim + 0.40*ftbSim
+// slide moves the window one note further
+func (w *windowHistograms) slide() {
+	n := w.notes
+	w.atb[n[w.start]]--
+	w.atb[n[w.end]]++
+	if w.end-w.start > 1 {
+		w.rtb[n[w.start+1]-n[w.start]+127]--
+		w.rtb[n[w.end]-n[w.end-1]+127]++
+	}
+	w.start++
+	w.end++
+}
 
-		// Update maximum similarity score
-		if similarity > maxSimilarity {
-			maxSimilarity = similarity
+// histograms returns the ATB, RTB and FTB of the window. They are only valid until the next
+// slide, and are normalized copies when normalize is set.
+func (w *windowHistograms) histograms(normalize bool) (atb, rtb, ftb []float64) {
+	clear(w.ftb)
+	first := w.notes[w.start]
+	for pitch, count := range w.atb {
+		if count != 0 {
+			w.ftb[pitch-first+127] = count
 		}
 	}
-
-	return maxSimilarity
+	if !normalize {
+		return w.atb, w.rtb, w.ftb
+	}
+	atb = normalizeHistogram(append([]float64(nil), w.atb...))
+	rtb = normalizeHistogram(append([]float64(nil), w.rtb...))
+	ftb = normalizeHistogram(append([]float64(nil), w.ftb...))
+	return atb, rtb, ftb
 }
@@ -0,0 +1,421 @@
+// color_feature_helpers.go contains the color histograms, palettes and RGB PCA of album covers and their weighting against the grayscale score
+package helpers
+
+import (
+	"bos/pablo/types"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ColorFeatureVersion changes whenever the color features are computed differently, so stored
+// features of an older version are recomputed
+const ColorFeatureVersion = 1
+
+// Layout of the color features
+const (
+	colorSampleSize    = 64 // covers are averaged down to this many pixels per side first
+	hsvHueBins         = 12
+	hsvSaturationBins  = 4
+	hsvValueBins       = 4
+	labLightnessBins   = 5
+	labChromaBins      = 9     // bins of a and of b, odd so neutral colors fall in the middle one
+	labChromaRange     = 110.0 // a and b are clipped to ±labChromaRange
+	paletteSize        = 5
+	paletteIterations  = 10
+	paletteMaxDistance = 60.0 // CIELAB distance at which two palettes share nothing
+)
+
+// The RGB PCA similarity is mostly the distance between the mean colors, relative to the
+// diagonal of the RGB cube, and then the spread along and direction of the principal axes
+const (
+	rgbMeanShare       = 0.5
+	rgbDeviationShare  = 0.25
+	rgbAlignmentShare  = 0.25
+	rgbMaxMeanDistance = 255 * 1.7320508075688772 // sqrt(3)
+)
+
+// maxImageWeight bounds every image weight
+const maxImageWeight = 100.0
+
+// ImageWeights are the relative weights of the grayscale similarity and of every color
+// similarity. They are scaled to sum to 1 when combined, so the score stays in [0, 1].
+type ImageWeights struct {
+	Gray    float64 `json:"gray"`
+	HSV     float64 `json:"hsv"`
+	Lab     float64 `json:"lab"`
+	Palette float64 `json:"palette"`
+	RGBPCA  float64 `json:"rgbPca"`
+}
+
+// DefaultImageWeights are used for every weight a request does not set. The color features
+// are off unless a weight enables them; main overrides them from the IMAGE_WEIGHT_*
+// environment variables at startup.
+var DefaultImageWeights = ImageWeights{Gray: 1}
+
+// ColorSimilarity holds the similarities of two covers per color feature
+type ColorSimilarity struct {
+	HSV     float64 `json:"hsv"`
+	Lab     float64 `json:"lab"`
+	Palette float64 `json:"palette"`
+	RGBPCA  float64 `json:"rgbPca"`
+}
+
+// UsesColor tells whether any color feature is weighted
+func (w ImageWeights) UsesColor() bool {
+	return w.HSV+w.Lab+w.Palette+w.RGBPCA > 0
+}
+
+// Combine returns the weighted mean of the grayscale similarity and the color similarities.
+// Without color similarities the grayscale similarity is returned as is.
+func (w ImageWeights) Combine(gray float64, color *ColorSimilarity) float64 {
+	if color == nil || !w.UsesColor() {
+		return gray
+	}
+	total := w.Gray + w.HSV + w.Lab + w.Palette + w.RGBPCA
+	return (w.Gray*gray + w.HSV*color.HSV + w.Lab*color.Lab + w.Palette*color.Palette + w.RGBPCA*color.RGBPCA) / total
+}
+
+// LoadImageWeightsFromEnv replaces DefaultImageWeights with the values of IMAGE_WEIGHT_GRAY,
+// IMAGE_WEIGHT_HSV, IMAGE_WEIGHT_LAB, IMAGE_WEIGHT_PALETTE and IMAGE_WEIGHT_RGB_PCA. Unset or
+// empty variables keep their default.
+func LoadImageWeightsFromEnv() error {
+	weights, err := ParseImageWeights(DefaultImageWeights, func(key string) (string, bool) {
+		return os.LookupEnv("IMAGE_" + strings.ToUpper(key))
+	})
+	if err != nil {
+		return err
+	}
+	DefaultImageWeights = weights
+	return nil
+}
+
+// ParseImageWeights overrides base with the weights returned by get and validates the result.
+// Keys are weight_gray, weight_hsv, weight_lab, weight_palette and weight_rgb_pca.
+func ParseImageWeights(base ImageWeights, get func(key string) (string, bool)) (ImageWeights, error) {
+	weights := base
+	targets := map[string]*float64{
+		"weight_gray":    &weights.Gray,
+		"weight_hsv":     &weights.HSV,
+		"weight_lab":     &weights.Lab,
+		"weight_palette": &weights.Palette,
+		"weight_rgb_pca": &weights.RGBPCA,
+	}
+	for key, target := range targets {
+		value, ok := get(key)
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return base, fmt.Errorf("%s must be a number, got %q", key, value)
+		}
+		if !(parsed >= 0 && parsed <= maxImageWeight) {
+			return base, fmt.Errorf("%s must be between 0 and %g", key, maxImageWeight)
+		}
+		*target = parsed
+	}
+	if weights.Gray+weights.HSV+weights.Lab+weights.Palette+weights.RGBPCA == 0 {
+		return base, fmt.Errorf("at least one image weight must be positive")
+	}
+	return weights, nil
+}
+
+// ExtractColorFeaturesFile computes the color features of an image file
+func ExtractColorFeaturesFile(path string) (types.ColorFeatures, error) {
+	img, err := loadImage(path)
+	if err != nil {
+		return types.ColorFeatures{}, fmt.Errorf("error loading image from path %s: %w", path, err)
+	}
+	return ExtractColorFeatures(img), nil
+}
+
+// ExtractColorFeatures computes the HSV and CIELAB histograms, the dominant palette and the
+// principal axes of the RGB values of an image
+func ExtractColorFeatures(img image.Image) types.ColorFeatures {
+	pixels := areaResizeRGB(img, colorSampleSize, colorSampleSize)
+	features := types.ColorFeatures{
+		Version: ColorFeatureVersion,
+		HSV:     make([]float64, hsvHueBins*hsvSaturationBins*hsvValueBins),
+		Lab:     make([]float64, labLightnessBins*labChromaBins*labChromaBins),
+	}
+
+	// bin clips value from low to high into one of count bins
+	bin := func(value, low, high float64, count int) int {
+		return max(0, min(int((value-low)/(high-low)*float64(count)), count-1))
+	}
+
+	labs := make([][3]float64, len(pixels))
+	for i, rgb := range pixels {
+		h, s, v := rgbToHSV(rgb)
+		hueBin := bin(h, 0, 360, hsvHueBins)
+		saturationBin := bin(s, 0, 1, hsvSaturationBins)
+		valueBin := bin(v, 0, 1, hsvValueBins)
+		features.HSV[(hueBin*hsvSaturationBins+saturationBin)*hsvValueBins+valueBin]++
+
+		labs[i] = rgbToLab(rgb)
+		lightnessBin := bin(labs[i][0], 0, 100, labLightnessBins)
+		aBin := bin(labs[i][1], -labChromaRange, labChromaRange, labChromaBins)
+		bBin := bin(labs[i][2], -labChromaRange, labChromaRange, labChromaBins)
+		features.Lab[(lightnessBin*labChromaBins+aBin)*labChromaBins+bBin]++
+	}
+
+	features.Palette = dominantPalette(labs, paletteSize)
+	features.RGBMean, features.RGBDeviation, features.RGBAxes = rgbPrincipalAxes(pixels)
+	return features
+}
+
+// CompareColorFeatures scores two covers on every color feature, 1 meaning identical colors
+func CompareColorFeatures(a, b types.ColorFeatures) ColorSimilarity {
+	return ColorSimilarity{
+		HSV:     intersectionSimilarity(a.HSV, b.HSV),
+		Lab:     intersectionSimilarity(a.Lab, b.Lab),
+		Palette: paletteSimilarity(a.Palette, b.Palette),
+		RGBPCA:  rgbPCASimilarity(a, b),
+	}
+}
+
+// paletteSimilarity maps the weighted distance from every color of one palette to the closest
+// color of the other, averaged both ways, to [0, 1]
+func paletteSimilarity(a, b []types.PaletteColor) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	closest := func(from, to []types.PaletteColor) float64 {
+		var total float64
+		for _, color := range from {
+			best := math.Inf(1)
+			for _, other := range to {
+				best = math.Min(best, math.Sqrt(labDistanceSquared(
+					[3]float64{color.L, color.A, color.B}, [3]float64{other.L, other.A, other.B})))
+			}
+			total += color.Weight * best
+		}
+		return total
+	}
+	distance := (closest(a, b) + closest(b, a)) / 2
+	return math.Max(0, 1-distance/paletteMaxDistance)
+}
+
+// rgbPCASimilarity compares the mean colors, the spreads along the principal axes and the
+// directions of the strongest axes of two covers
+func rgbPCASimilarity(a, b types.ColorFeatures) float64 {
+	var meanDistance, deviationDifference, deviationTotal float64
+	for c := 0; c < 3; c++ {
+		meanDistance += (a.RGBMean[c] - b.RGBMean[c]) * (a.RGBMean[c] - b.RGBMean[c])
+		deviationDifference += math.Abs(a.RGBDeviation[c] - b.RGBDeviation[c])
+		deviationTotal += a.RGBDeviation[c] + b.RGBDeviation[c]
+	}
+	mean := math.Max(0, 1-math.Sqrt(meanDistance)/rgbMaxMeanDistance)
+	deviation := 1.0
+	if deviationTotal > 0 {
+		deviation = 1 - deviationDifference/deviationTotal
+	}
+	// Axes point either way, so only the angle between the lines counts
+	alignment := math.Abs(a.RGBAxes[0][0]*b.RGBAxes[0][0] + a.RGBAxes[0][1]*b.RGBAxes[0][1] + a.RGBAxes[0][2]*b.RGBAxes[0][2])
+	return rgbMeanShare*mean + rgbDeviationShare*deviation + rgbAlignmentShare*alignment
+}
+
+// areaResizeRGB shrinks an image to width by height pixels, each the mean RGB, from 0 to 255,
+// of the source pixels it covers
+func areaResizeRGB(img image.Image, width, height int) [][3]float64 {
+	bounds := img.Bounds()
+	pixels := make([][3]float64, 0, width*height)
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var sum [3]float64
+			count := 0
+			for sy := y0; sy < y1 && sy < bounds.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < bounds.Max.X; sx++ {
+					r, g, b, _ := img.At(sx, sy).RGBA()
+					sum[0] += float64(r) / 257
+					sum[1] += float64(g) / 257
+					sum[2] += float64(b) / 257
+					count++
+				}
+			}
+			if count > 0 {
+				pixels = append(pixels, [3]float64{sum[0] / float64(count), sum[1] / float64(count), sum[2] / float64(count)})
+			}
+		}
+	}
+	return pixels
+}
+
+// rgbToHSV returns the hue in degrees and the saturation and value in [0, 1]
+func rgbToHSV(rgb [3]float64) (float64, float64, float64) {
+	r, g, b := rgb[0]/255, rgb[1]/255, rgb[2]/255
+	high := math.Max(r, math.Max(g, b))
+	low := math.Min(r, math.Min(g, b))
+	delta := high - low
+
+	var hue float64
+	switch {
+	case delta == 0:
+		hue = 0
+	case high == r:
+		hue = 60 * math.Mod((g-b)/delta, 6)
+	case high == g:
+		hue = 60 * ((b-r)/delta + 2)
+	default:
+		hue = 60 * ((r-g)/delta + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+	saturation := 0.0
+	if high > 0 {
+		saturation = delta / high
+	}
+	return hue, saturation, high
+}
+
+// rgbToLab converts an sRGB color to CIELAB under the D65 white point
+func rgbToLab(rgb [3]float64) [3]float64 {
+	var linear [3]float64
+	for c, value := range rgb {
+		value /= 255
+		if value <= 0.04045 {
+			linear[c] = value / 12.92
+		} else {
+			linear[c] = math.Pow((value+0.055)/1.055, 2.4)
+		}
+	}
+	x := (0.4124*linear[0] + 0.3576*linear[1] + 0.1805*linear[2]) / 0.95047
+	y := 0.2126*linear[0] + 0.7152*linear[1] + 0.0722*linear[2]
+	z := (0.0193*linear[0] + 0.1192*linear[1] + 0.9505*linear[2]) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func labDistanceSquared(a, b [3]float64) float64 {
+	return (a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2])
+}
+
+// dominantPalette clusters CIELAB colors with k-means. The centers start at the color closest
+// to the mean and then each farthest from the centers so far, which keeps it deterministic.
+func dominantPalette(labs [][3]float64, k int) []types.PaletteColor {
+	if len(labs) == 0 {
+		return nil
+	}
+	k = min(k, len(labs))
+
+	var mean [3]float64
+	for _, lab := range labs {
+		for c := range mean {
+			mean[c] += lab[c] / float64(len(labs))
+		}
+	}
+	nearest := func(lab [3]float64, centers [][3]float64) (int, float64) {
+		best, bestDistance := 0, math.Inf(1)
+		for i, center := range centers {
+			if distance := labDistanceSquared(lab, center); distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		return best, bestDistance
+	}
+
+	first, _ := nearest(mean, labs)
+	centers := [][3]float64{labs[first]}
+	for len(centers) < k {
+		farthest, farthestDistance := -1, 0.0
+		for i, lab := range labs {
+			if _, distance := nearest(lab, centers); distance > farthestDistance {
+				farthest, farthestDistance = i, distance
+			}
+		}
+		if farthest < 0 {
+			break // fewer distinct colors than k
+		}
+		centers = append(centers, labs[farthest])
+	}
+
+	assignment := make([]int, len(labs))
+	for iter := 0; iter < paletteIterations; iter++ {
+		for i, lab := range labs {
+			assignment[i], _ = nearest(lab, centers)
+		}
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, lab := range labs {
+			for c := range lab {
+				sums[assignment[i]][c] += lab[c]
+			}
+			counts[assignment[i]]++
+		}
+		for i := range centers {
+			if counts[i] > 0 {
+				for c := range centers[i] {
+					centers[i][c] = sums[i][c] / float64(counts[i])
+				}
+			}
+		}
+	}
+
+	counts := make([]int, len(centers))
+	for i, lab := range labs {
+		assignment[i], _ = nearest(lab, centers)
+		counts[assignment[i]]++
+	}
+	palette := make([]types.PaletteColor, 0, len(centers))
+	for i, center := range centers {
+		if counts[i] == 0 {
+			continue
+		}
+		palette = append(palette, types.PaletteColor{
+			L: center[0], A: center[1], B: center[2],
+			Weight: float64(counts[i]) / float64(len(labs)),
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Weight > palette[j].Weight })
+	return palette
+}
+
+// rgbPrincipalAxes returns the mean RGB color and the standard deviations along and directions
+// of the principal axes of the RGB values
+func rgbPrincipalAxes(pixels [][3]float64) ([3]float64, [3]float64, [3][3]float64) {
+	var mean, deviation [3]float64
+	var axes [3][3]float64
+	if len(pixels) < 2 {
+		return mean, deviation, axes
+	}
+
+	rows := make([][]float64, len(pixels))
+	for i, rgb := range pixels {
+		rows[i] = []float64{rgb[0], rgb[1], rgb[2]}
+	}
+	observations := types.NewMatrix(rows)
+	copy(mean[:], observations.ColumnMeans())
+
+	covariance, err := observations.Covariance()
+	if err != nil {
+		return mean, deviation, axes
+	}
+	values, vectors, err := covariance.SymmetricEigen()
+	if err != nil {
+		return mean, deviation, axes
+	}
+	for k := 0; k < 3; k++ {
+		deviation[k] = math.Sqrt(math.Max(0, values[k]))
+		copy(axes[k][:], vectors.Column(k))
+	}
+	return mean, deviation, axes
+}
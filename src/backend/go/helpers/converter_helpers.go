@@ -0,0 +1,100 @@
+// converter_helpers.go contains the Converter interface and the in-process and fake implementations
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Converter turns an uploaded audio or MIDI file into a MIDI file and a notes file,
+// returning both paths
+type Converter interface {
+	Convert(ctx context.Context, audioPath string) (string, string, error)
+}
+
+// NativeConverter converts MIDI files, and WAV files when TranscribeWav is set, in-process.
+// Every other format goes to Fallback, or fails when no fallback is set.
+type NativeConverter struct {
+	TranscribeWav bool // the pitch tracker is monophonic, so this suits hummings rather than songs
+	Fallback      Converter
+}
+
+// Convert parses MIDI files and transcribes WAV files without calling the converter service
+func (n *NativeConverter) Convert(ctx context.Context, audioPath string) (string, string, error) {
+	switch {
+	case IsMidiFile(audioPath):
+		return ConvertMidiNatively(audioPath)
+	case IsWavFile(audioPath) && n.TranscribeWav:
+		return ConvertWavNatively(audioPath)
+	case n.Fallback != nil:
+		return n.Fallback.Convert(ctx, audioPath)
+	default:
+		return "", "", fmt.Errorf("native converter only supports MIDI and WAV files, got %s", filepath.Ext(audioPath))
+	}
+}
+
+// FakeConverter returns fixed notes for every file and records the paths it was called with.
+// It is meant for tests and for running the backend without any transcription.
+type FakeConverter struct {
+	Notes []NoteEvent
+	Err   error
+
+	mu    sync.Mutex
+	Calls []string
+}
+
+// Convert writes the fixed notes next to audioPath and returns audioPath as the MIDI path
+func (f *FakeConverter) Convert(ctx context.Context, audioPath string) (string, string, error) {
+	f.mu.Lock()
+	f.Calls = append(f.Calls, audioPath)
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return "", "", f.Err
+	}
+
+	basePath := strings.TrimSuffix(audioPath, filepath.Ext(audioPath))
+	jsonPath := fmt.Sprintf("%s_%s_data.json", basePath, strings.ReplaceAll(uuid.New().String(), "-", ""))
+	if err := SaveNotesToJSON(jsonPath, f.Notes, HasTiming(f.Notes)); err != nil {
+		return "", "", err
+	}
+	return audioPath, jsonPath, nil
+}
+
+// ConverterSet bundles the converters used for song uploads and humming queries
+type ConverterSet struct {
+	Songs   Converter // native for MIDI, remote for everything else
+	Humming Converter // native for MIDI and WAV, remote for everything else
+	Native  Converter
+	Remote  Converter
+}
+
+// NewConverterSet builds the standard set around the converter service client
+func NewConverterSet(remote Converter) ConverterSet {
+	return ConverterSet{
+		Songs:   &NativeConverter{Fallback: remote},
+		Humming: &NativeConverter{TranscribeWav: true, Fallback: remote},
+		Native:  &NativeConverter{TranscribeWav: true},
+		Remote:  remote,
+	}
+}
+
+// HummingConverter returns the converter for a transcriber name: "native", "python",
+// or "" for the humming default
+func (s ConverterSet) HummingConverter(name string) (Converter, error) {
+	switch name {
+	case "":
+		return s.Humming, nil
+	case "native":
+		return s.Native, nil
+	case "python":
+		return s.Remote, nil
+	default:
+		return nil, fmt.Errorf("unknown transcriber %q, expected native or python", name)
+	}
+}
@@ -0,0 +1,149 @@
+// dtw_helpers.go contains a transposition and tempo invariant melody matcher based on dynamic time warping
+package helpers
+
+import (
+	"math"
+	"sort"
+)
+
+// DTWOptions controls the contour DTW matcher
+type DTWOptions struct {
+	Band           float64   // Sakoe-Chiba band radius as a fraction of the longer sequence
+	WindowScales   []float64 // song window lengths relative to the query length
+	KeyShifts      []float64 // extra semitone shifts tried around the median alignment
+	DurationWeight float64   // weight of the tempo-normalized duration difference in the local cost
+}
+
+// DefaultDTWOptions are the options used when a request does not override them
+var DefaultDTWOptions = DTWOptions{
+	Band:           0.15,
+	WindowScales:   []float64{0.75, 1, 1.25, 1.5},
+	KeyShifts:      []float64{-1, 0, 1},
+	DurationWeight: 0.5,
+}
+
+// contourPoint is one note of a key and tempo normalized melody contour
+type contourPoint struct {
+	pitch    float64 // semitones relative to the median pitch
+	duration float64 // log2 of the duration relative to the median duration
+}
+
+// MatchMelodyDTW finds the song window with the smallest DTW distance to the query. Each
+// window is key-normalized by its median pitch and tempo-normalized by its median duration
+// before alignment. The score is 1 / (1 + distance).
+func MatchMelodyDTW(query, song []NoteEvent, opts DTWOptions) MelodyMatch {
+	if len(query) == 0 || len(song) == 0 {
+		return MelodyMatch{}
+	}
+
+	useDuration := opts.DurationWeight > 0 && HasTiming(query) && HasTiming(song)
+	queryContour := buildContour(query, useDuration)
+
+	n := len(query)
+	hop := max(1, n/4)
+	bestDistance := math.Inf(1)
+	bestStart, bestEnd, bestShift := 0, 0, 0.0
+
+	for _, scale := range opts.WindowScales {
+		windowSize := int(math.Round(scale * float64(n)))
+		windowSize = max(1, min(windowSize, len(song)))
+
+		for start := 0; start+windowSize <= len(song); start += hop {
+			songContour := buildContour(song[start:start+windowSize], useDuration)
+
+			for _, shift := range opts.KeyShifts {
+				distance := dtwDistance(queryContour, songContour, shift, opts)
+				if distance < bestDistance {
+					bestDistance = distance
+					bestStart, bestEnd, bestShift = start, start+windowSize, shift
+				}
+			}
+		}
+	}
+
+	if math.IsInf(bestDistance, 1) {
+		return MelodyMatch{}
+	}
+	features := map[string]float64{"distance": bestDistance, "keyShift": bestShift}
+	return newMelodyMatch(1/(1+bestDistance), features, song, bestStart, bestEnd, HasTiming(song))
+}
+
+func buildContour(notes []NoteEvent, useDuration bool) []contourPoint {
+	pitches := make([]float64, len(notes))
+	durations := make([]float64, 0, len(notes))
+	for i, note := range notes {
+		pitches[i] = float64(note.Pitch)
+		if note.Duration > 0 {
+			durations = append(durations, note.Duration)
+		}
+	}
+
+	pitchCenter := median(pitches)
+	durationCenter := median(durations)
+
+	contour := make([]contourPoint, len(notes))
+	for i, note := range notes {
+		contour[i].pitch = float64(note.Pitch) - pitchCenter
+		if useDuration && note.Duration > 0 && durationCenter > 0 {
+			contour[i].duration = math.Log2(note.Duration / durationCenter)
+		}
+	}
+	return contour
+}
+
+// dtwDistance aligns a and b inside a band around the diagonal and returns the
+// accumulated cost normalized by the combined length
+func dtwDistance(a, b []contourPoint, shift float64, opts DTWOptions) float64 {
+	n, m := len(a), len(b)
+	radius := int(math.Ceil(opts.Band * float64(max(n, m))))
+	radius = max(radius, 1)
+
+	inf := math.Inf(1)
+	prev := make([]float64, m+1)
+	curr := make([]float64, m+1)
+	for j := range prev {
+		prev[j] = inf
+	}
+	prev[0] = 0
+
+	for i := 1; i <= n; i++ {
+		for j := range curr {
+			curr[j] = inf
+		}
+
+		// The band follows the diagonal of the n x m grid
+		center := int(math.Round(float64(i) * float64(m) / float64(n)))
+		lo := max(1, center-radius)
+		hi := min(m, center+radius)
+
+		for j := lo; j <= hi; j++ {
+			cost := math.Min(math.Abs(a[i-1].pitch+shift-b[j-1].pitch), 12)
+			cost += opts.DurationWeight * math.Min(math.Abs(a[i-1].duration-b[j-1].duration), 2)
+
+			best := prev[j-1]
+			if prev[j] < best {
+				best = prev[j]
+			}
+			if curr[j-1] < best {
+				best = curr[j-1]
+			}
+			curr[j] = cost + best
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[m] / float64(n+m)
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,193 @@
+// evaluation_helpers.go contains the retrieval metrics and report files of the offline evaluation command
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EvaluationQuery is the outcome of one labeled query
+type EvaluationQuery struct {
+	File      string   `json:"file"`
+	Kind      string   `json:"kind"` // "audio" or "image"
+	Expected  []string `json:"expected"`
+	Rank      int      `json:"rank"`                // 1-based rank of the first correct result, 0 when not returned
+	TopResult string   `json:"topResult,omitempty"` // name of the first result
+	LatencyMs float64  `json:"latencyMs"`           // preprocessing and search
+	Error     string   `json:"error,omitempty"`
+}
+
+// LatencyStats summarizes query latencies in milliseconds
+type LatencyStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// EvaluationSummary aggregates the queries of one kind
+type EvaluationSummary struct {
+	Kind    string       `json:"kind"`
+	Queries int          `json:"queries"`
+	Failed  int          `json:"failed"` // queries that could not be searched, counted as misses
+	Top1    float64      `json:"top1"`
+	Top5    float64      `json:"top5"`
+	Top9    float64      `json:"top9"`
+	MRR     float64      `json:"mrr"`
+	Latency LatencyStats `json:"latencyMs"`
+}
+
+// EvaluationReport is the result of one evaluation run
+type EvaluationReport struct {
+	CreatedAt time.Time           `json:"createdAt"`
+	Config    map[string]any      `json:"config"` // algorithm settings the run used
+	Summaries []EvaluationSummary `json:"summaries"`
+	Queries   []EvaluationQuery   `json:"queries"`
+}
+
+// SummarizeEvaluation computes accuracy at 1, 5 and 9, the mean reciprocal rank and the
+// latency percentiles of the queries, per kind in alphabetical order
+func SummarizeEvaluation(queries []EvaluationQuery) []EvaluationSummary {
+	byKind := map[string][]EvaluationQuery{}
+	for _, query := range queries {
+		byKind[query.Kind] = append(byKind[query.Kind], query)
+	}
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	summaries := make([]EvaluationSummary, 0, len(kinds))
+	for _, kind := range kinds {
+		summary := EvaluationSummary{Kind: kind, Queries: len(byKind[kind])}
+		var latencies []float64
+		for _, query := range byKind[kind] {
+			if query.Error != "" {
+				summary.Failed++
+			}
+			if query.Rank >= 1 {
+				summary.MRR += 1 / float64(query.Rank)
+				if query.Rank == 1 {
+					summary.Top1++
+				}
+				if query.Rank <= 5 {
+					summary.Top5++
+				}
+				if query.Rank <= 9 {
+					summary.Top9++
+				}
+			}
+			latencies = append(latencies, query.LatencyMs)
+		}
+		count := float64(summary.Queries)
+		summary.Top1 /= count
+		summary.Top5 /= count
+		summary.Top9 /= count
+		summary.MRR /= count
+		summary.Latency = latencyStats(latencies)
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// latencyStats computes nearest-rank percentiles
+func latencyStats(latencies []float64) LatencyStats {
+	if len(latencies) == 0 {
+		return LatencyStats{}
+	}
+	sorted := append([]float64(nil), latencies...)
+	sort.Float64s(sorted)
+
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+		return sorted[max(0, rank-1)]
+	}
+	var sum float64
+	for _, latency := range sorted {
+		sum += latency
+	}
+	return LatencyStats{
+		Mean: sum / float64(len(sorted)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P95:  percentile(95),
+		P99:  percentile(99),
+		Max:  sorted[len(sorted)-1],
+	}
+}
+
+// WriteEvaluationReport writes the report to prefix.json and prefix.md and returns both paths
+func WriteEvaluationReport(report EvaluationReport, prefix string) (string, string, error) {
+	if dir := filepath.Dir(prefix); dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return "", "", err
+		}
+	}
+
+	jsonPath, markdownPath := prefix+".json", prefix+".md"
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(jsonPath, data, 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(markdownPath, []byte(EvaluationMarkdown(report)), 0644); err != nil {
+		return "", "", err
+	}
+	return jsonPath, markdownPath, nil
+}
+
+// EvaluationMarkdown renders the report as Markdown tables
+func EvaluationMarkdown(report EvaluationReport) string {
+	var b strings.Builder
+	b.WriteString("# Retrieval evaluation\n\n")
+	fmt.Fprintf(&b, "Run at %s.\n\n", report.CreatedAt.Format(time.RFC3339))
+
+	keys := make([]string, 0, len(report.Config))
+	for key := range report.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := json.Marshal(report.Config[key])
+		fmt.Fprintf(&b, "- %s: `%s`\n", key, value)
+	}
+
+	b.WriteString("\n## Summary\n\n")
+	b.WriteString("| kind | queries | failed | top-1 | top-5 | top-9 | MRR | p50 ms | p90 ms | p95 ms | p99 ms | max ms |\n")
+	b.WriteString("| ---- | ------- | ------ | ----- | ----- | ----- | --- | ------ | ------ | ------ | ------ | ------ |\n")
+	for _, s := range report.Summaries {
+		fmt.Fprintf(&b, "| %s | %d | %d | %.3f | %.3f | %.3f | %.3f | %.1f | %.1f | %.1f | %.1f | %.1f |\n",
+			s.Kind, s.Queries, s.Failed, s.Top1, s.Top5, s.Top9, s.MRR,
+			s.Latency.P50, s.Latency.P90, s.Latency.P95, s.Latency.P99, s.Latency.Max)
+	}
+
+	b.WriteString("\n## Queries\n\n")
+	b.WriteString("| query | kind | expected | rank | top result | latency ms | error |\n")
+	b.WriteString("| ----- | ---- | -------- | ---- | ---------- | ---------- | ----- |\n")
+	for _, q := range report.Queries {
+		rank := "-"
+		if q.Rank > 0 {
+			rank = fmt.Sprint(q.Rank)
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %.1f | %s |\n",
+			markdownCell(q.File), q.Kind, markdownCell(strings.Join(q.Expected, ", ")), rank,
+			markdownCell(q.TopResult), q.LatencyMs, markdownCell(q.Error))
+	}
+	return b.String()
+}
+
+// markdownCell escapes the characters that would break a table cell
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(text)
+}
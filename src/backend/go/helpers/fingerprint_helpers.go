@@ -0,0 +1,276 @@
+// fingerprint_helpers.go contains the spectrogram peak fingerprinter used to find songs from recordings of their audio
+package helpers
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+)
+
+// FingerprintOptions controls how audio is turned into landmark hashes
+type FingerprintOptions struct {
+	Version        int     // bump when fingerprints computed with older options must be rebuilt
+	SampleRate     int     // audio is resampled to this rate before analysis
+	FrameSize      int     // FFT size in samples, a power of two up to 2048
+	HopSize        int     // samples between frames
+	PeakTime       int     // a peak is the loudest bin within this many frames before and after
+	PeakFrequency  int     // and within this many bins below and above
+	PeaksPerSecond int     // only the strongest peaks of every second are kept
+	DynamicRange   float64 // peaks more than this many dB below the loudest bin are ignored
+	Prominence     float64 // peaks must be this many dB louder than the mean of their frame
+	FanOut         int     // each peak is paired with this many of the peaks that follow it
+	MaxDelta       int     // paired peaks are at most this many frames apart, below 4096
+}
+
+// DefaultFingerprintOptions are used for both the stored songs and the recorded queries
+var DefaultFingerprintOptions = FingerprintOptions{
+	Version:        1,
+	SampleRate:     11025,
+	FrameSize:      1024,
+	HopSize:        512,
+	PeakTime:       6,
+	PeakFrequency:  12,
+	PeaksPerSecond: 30,
+	DynamicRange:   60,
+	Prominence:     15,
+	FanOut:         5,
+	MaxDelta:       63,
+}
+
+// Fingerprint is the hash of a pair of spectrogram peaks and the frame of the first peak
+type Fingerprint struct {
+	Hash  uint32
+	Frame int
+}
+
+// FingerprintHit is a stored fingerprint of a song
+type FingerprintHit struct {
+	SongID uint
+	Frame  int
+}
+
+// RecordingMatch is a song whose fingerprints line up with a recording
+type RecordingMatch struct {
+	SongID  uint
+	Matches int // fingerprints agreeing on the offset
+	Offset  int // song frame at which the recording starts
+}
+
+// spectralPeak is one local maximum of a spectrogram
+type spectralPeak struct {
+	frame     int
+	bin       int
+	magnitude float64
+}
+
+// FrameSeconds returns the duration of one spectrogram frame step in seconds
+func (o FingerprintOptions) FrameSeconds() float64 {
+	return float64(o.HopSize) / float64(o.SampleRate)
+}
+
+// FingerprintWavFile fingerprints the audio of a WAV file
+func FingerprintWavFile(path string, opts FingerprintOptions) ([]Fingerprint, error) {
+	audio, err := LoadWavFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FingerprintAudio(audio.Samples, audio.SampleRate, opts), nil
+}
+
+// FingerprintAudio finds the peaks of the spectrogram of mono samples and hashes every peak
+// together with the next opts.FanOut peaks as (first bin, second bin, frame distance)
+func FingerprintAudio(samples []float64, sampleRate int, opts FingerprintOptions) []Fingerprint {
+	samples = Resample(samples, sampleRate, opts.SampleRate)
+	spectrogram := Spectrogram(samples, opts.FrameSize, opts.HopSize)
+	return hashPeaks(findSpectralPeaks(spectrogram, opts), opts)
+}
+
+// Spectrogram returns the magnitude in dB of the Hann-windowed FFT of every frame, without
+// the DC bin. Frames are indexed [frame][bin].
+func Spectrogram(samples []float64, frameSize, hopSize int) [][]float64 {
+	if len(samples) < frameSize {
+		return nil
+	}
+
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+
+	frameCount := (len(samples)-frameSize)/hopSize + 1
+	spectrogram := make([][]float64, frameCount)
+	buffer := make([]complex128, frameSize)
+	for f := range spectrogram {
+		start := f * hopSize
+		for i := range buffer {
+			buffer[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(buffer)
+
+		magnitudes := make([]float64, frameSize/2-1)
+		for bin := range magnitudes {
+			magnitudes[bin] = 20 * math.Log10(cmplx.Abs(buffer[bin+1])+1e-10)
+		}
+		spectrogram[f] = magnitudes
+	}
+	return spectrogram
+}
+
+// fft computes the discrete Fourier transform in place. The length must be a power of two.
+func fft(values []complex128) {
+	n := len(values)
+
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := values[start+k], values[start+k+size/2]*w
+				values[start+k] = even + odd
+				values[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// findSpectralPeaks keeps the bins that are the loudest of their neighbourhood and stand out
+// from their frame and from silence, and then the strongest opts.PeaksPerSecond of every second
+func findSpectralPeaks(spectrogram [][]float64, opts FingerprintOptions) []spectralPeak {
+	if len(spectrogram) == 0 {
+		return nil
+	}
+
+	loudest := math.Inf(-1)
+	for _, frame := range spectrogram {
+		for _, magnitude := range frame {
+			loudest = math.Max(loudest, magnitude)
+		}
+	}
+	floor := loudest - opts.DynamicRange
+
+	// Separable maximum filter, first over frequency then over time
+	bins := len(spectrogram[0])
+	byFrequency := make([][]float64, len(spectrogram))
+	for f, frame := range spectrogram {
+		byFrequency[f] = make([]float64, bins)
+		for bin := range frame {
+			lo, hi := max(0, bin-opts.PeakFrequency), min(bins-1, bin+opts.PeakFrequency)
+			highest := math.Inf(-1)
+			for b := lo; b <= hi; b++ {
+				highest = math.Max(highest, frame[b])
+			}
+			byFrequency[f][bin] = highest
+		}
+	}
+
+	peaksBySecond := map[int][]spectralPeak{}
+	for f, frame := range spectrogram {
+		lo, hi := max(0, f-opts.PeakTime), min(len(spectrogram)-1, f+opts.PeakTime)
+		var mean float64
+		for _, magnitude := range frame {
+			mean += magnitude
+		}
+		threshold := math.Max(floor, mean/float64(len(frame))+opts.Prominence)
+
+		for bin, magnitude := range frame {
+			if magnitude < threshold {
+				continue
+			}
+			isPeak := true
+			for t := lo; t <= hi && isPeak; t++ {
+				isPeak = byFrequency[t][bin] <= magnitude
+			}
+			if isPeak {
+				second := int(float64(f) * opts.FrameSeconds())
+				peaksBySecond[second] = append(peaksBySecond[second], spectralPeak{frame: f, bin: bin, magnitude: magnitude})
+			}
+		}
+	}
+
+	var peaks []spectralPeak
+	for _, secondPeaks := range peaksBySecond {
+		sort.Slice(secondPeaks, func(i, j int) bool {
+			return secondPeaks[i].magnitude > secondPeaks[j].magnitude
+		})
+		if len(secondPeaks) > opts.PeaksPerSecond {
+			secondPeaks = secondPeaks[:opts.PeaksPerSecond]
+		}
+		peaks = append(peaks, secondPeaks...)
+	}
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].frame != peaks[j].frame {
+			return peaks[i].frame < peaks[j].frame
+		}
+		return peaks[i].bin < peaks[j].bin
+	})
+	return peaks
+}
+
+// hashPeaks pairs every peak with the peaks that follow it within opts.MaxDelta frames. The
+// hash packs the two bins in 10 bits each and the frame distance in 12 bits.
+func hashPeaks(peaks []spectralPeak, opts FingerprintOptions) []Fingerprint {
+	var prints []Fingerprint
+	for i, anchor := range peaks {
+		paired := 0
+		for _, target := range peaks[i+1:] {
+			delta := target.frame - anchor.frame
+			if delta > opts.MaxDelta || paired >= opts.FanOut {
+				break
+			}
+			if delta == 0 {
+				continue
+			}
+			hash := uint32(anchor.bin&0x3FF)<<22 | uint32(target.bin&0x3FF)<<12 | uint32(delta&0xFFF)
+			prints = append(prints, Fingerprint{Hash: hash, Frame: anchor.frame})
+			paired++
+		}
+	}
+	return prints
+}
+
+// AlignFingerprints counts, for every song, how many recording fingerprints agree on the
+// same offset into the song, and returns the songs by their best offset, best first
+func AlignFingerprints(query []Fingerprint, hits map[uint32][]FingerprintHit) []RecordingMatch {
+	type songOffset struct {
+		songID uint
+		offset int
+	}
+	votes := map[songOffset]int{}
+	for _, fingerprint := range query {
+		for _, hit := range hits[fingerprint.Hash] {
+			votes[songOffset{hit.SongID, hit.Frame - fingerprint.Frame}]++
+		}
+	}
+
+	best := map[uint]RecordingMatch{}
+	for key, count := range votes {
+		if current, ok := best[key.songID]; !ok || count > current.Matches || (count == current.Matches && key.offset < current.Offset) {
+			best[key.songID] = RecordingMatch{SongID: key.songID, Matches: count, Offset: key.offset}
+		}
+	}
+
+	matches := make([]RecordingMatch, 0, len(best))
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Matches != matches[j].Matches {
+			return matches[i].Matches > matches[j].Matches
+		}
+		return matches[i].SongID < matches[j].SongID
+	})
+	return matches
+}
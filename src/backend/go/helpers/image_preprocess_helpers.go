@@ -0,0 +1,331 @@
+// image_preprocess_helpers.go contains the configurable resampling, cropping and border trimming that turn album covers into flattened vectors
+package helpers
+
+import (
+	"bos/pablo/types"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultImagePreprocessing is how covers and queries are preprocessed. Resampling, fit and
+// trimming keep the original nearest-neighbour stretch unless configured; main overrides them
+// from the IMAGE_* environment variables at startup.
+var DefaultImagePreprocessing = types.ImagePreprocessing{
+	Width:           120,
+	Height:          120,
+	Resample:        "nearest",
+	Fit:             "stretch",
+	TrimBorders:     false,
+	ExifOrientation: true,
+}
+
+// Border trimming
+const (
+	borderTolerance = 12.0 // gray levels a border pixel may differ from the border color
+	borderCoverage  = 0.98 // share of a row or column that must match for it to be border
+)
+
+// resampleKernels are the interpolation filters by name, with their support in source pixels
+var resampleKernels = map[string]struct {
+	support float64
+	weight  func(t float64) float64
+}{
+	"bilinear": {1, func(t float64) float64 {
+		return math.Max(0, 1-math.Abs(t))
+	}},
+	"bicubic": {2, func(t float64) float64 {
+		// Catmull-Rom, the cubic convolution with a = -0.5
+		t = math.Abs(t)
+		switch {
+		case t < 1:
+			return 1.5*t*t*t - 2.5*t*t + 1
+		case t < 2:
+			return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+		}
+		return 0
+	}},
+	"lanczos": {3, func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		if math.Abs(t) >= 3 {
+			return 0
+		}
+		x := math.Pi * t
+		return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+	}},
+}
+
+// LoadImagePreprocessingFromEnv replaces DefaultImagePreprocessing with the values of
+// IMAGE_RESAMPLE, IMAGE_FIT, IMAGE_TRIM_BORDERS and IMAGE_EXIF_ORIENTATION. Unset or empty
+// variables keep their default.
+func LoadImagePreprocessingFromEnv() error {
+	options, err := ParseImagePreprocessing(DefaultImagePreprocessing, func(key string) (string, bool) {
+		return os.LookupEnv("IMAGE_" + strings.ToUpper(key))
+	})
+	if err != nil {
+		return err
+	}
+	DefaultImagePreprocessing = options
+	return nil
+}
+
+// ParseImagePreprocessing overrides base with the options returned by get and validates the
+// result. Keys are resample, fit, trim_borders and exif_orientation.
+func ParseImagePreprocessing(base types.ImagePreprocessing, get func(key string) (string, bool)) (types.ImagePreprocessing, error) {
+	options := base
+	lookup := func(key string) (string, bool) {
+		value, ok := get(key)
+		value = strings.ToLower(strings.TrimSpace(value))
+		return value, ok && value != ""
+	}
+
+	if value, ok := lookup("resample"); ok {
+		options.Resample = value
+	}
+	if value, ok := lookup("fit"); ok {
+		options.Fit = value
+	}
+	for key, target := range map[string]*bool{
+		"trim_borders":     &options.TrimBorders,
+		"exif_orientation": &options.ExifOrientation,
+	} {
+		if value, ok := lookup(key); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return base, fmt.Errorf("%s must be true or false, got %q", key, value)
+			}
+			*target = parsed
+		}
+	}
+
+	if _, ok := resampleKernels[options.Resample]; !ok && options.Resample != "nearest" {
+		return base, fmt.Errorf("resample must be nearest, bilinear, bicubic or lanczos, got %q", options.Resample)
+	}
+	if options.Fit != "stretch" && options.Fit != "crop" && options.Fit != "letterbox" {
+		return base, fmt.Errorf("fit must be stretch, crop or letterbox, got %q", options.Fit)
+	}
+	if options.Width < 1 || options.Height < 1 {
+		return base, fmt.Errorf("image size must be positive")
+	}
+	return options, nil
+}
+
+// PreprocessImage loads an image and turns it into a flattened grayscale vector of
+// options.Width by options.Height pixels. It returns how it did so as well, with the region of
+// the source that was kept.
+func PreprocessImage(imagePath string, options types.ImagePreprocessing) ([]float64, types.ImageFeatureMeta, error) {
+	meta := types.ImageFeatureMeta{Preprocessing: options}
+
+	// Load the image
+	pictureImg, err := decodeImage(imagePath, options.ExifOrientation)
+	if err != nil {
+		return nil, meta, fmt.Errorf("error loading image from path %s: %w", imagePath, err)
+	}
+
+	pixels := newGrayGrid(convertToGrayscale(pictureImg))
+	meta.SourceWidth, meta.SourceHeight = pixels.width, pixels.height
+	if pixels.width == 0 || pixels.height == 0 {
+		return nil, meta, fmt.Errorf("image %s is empty", imagePath)
+	}
+
+	// Keep the part of the image the options select
+	region := [4]int{0, 0, pixels.width, pixels.height}
+	if options.TrimBorders {
+		region = trimBorders(pixels, region)
+	}
+	aspect := float64(options.Width) / float64(options.Height)
+	if options.Fit == "crop" {
+		region = centerCrop(region, aspect)
+	}
+	meta.Region = region
+	if options.Fit == "letterbox" {
+		pixels, region = letterbox(pixels, region, aspect)
+	}
+
+	// Resize and flatten the kept region
+	return resampleGray(pixels, region, options.Width, options.Height, options.Resample), meta, nil
+}
+
+// grayGrid holds grayscale intensities from 0 to 255, row by row
+type grayGrid struct {
+	width, height int
+	pix           []float64
+}
+
+func newGrayGrid(img *image.Gray) grayGrid {
+	bounds := img.Bounds()
+	grid := grayGrid{width: bounds.Dx(), height: bounds.Dy(), pix: make([]float64, 0, bounds.Dx()*bounds.Dy())}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			grid.pix = append(grid.pix, float64(img.GrayAt(x, y).Y))
+		}
+	}
+	return grid
+}
+
+func (g grayGrid) at(x, y int) float64 {
+	return g.pix[y*g.width+x]
+}
+
+// trimBorders shrinks a region while its outermost rows and columns are nearly all the color
+// of its corners, such as the frame around a scanned or photographed cover. At most a quarter
+// of the region is trimmed from every side.
+func trimBorders(g grayGrid, region [4]int) [4]int {
+	x0, y0, x1, y1 := region[0], region[1], region[2], region[3]
+	border := (g.at(x0, y0) + g.at(x1-1, y0) + g.at(x0, y1-1) + g.at(x1-1, y1-1)) / 4
+
+	isBorder := func(fromX, fromY, stepX, stepY, count int) bool {
+		matching := 0
+		for i := 0; i < count; i++ {
+			if math.Abs(g.at(fromX+i*stepX, fromY+i*stepY)-border) <= borderTolerance {
+				matching++
+			}
+		}
+		return float64(matching) >= borderCoverage*float64(count)
+	}
+
+	maxX, maxY := (x1-x0)/4, (y1-y0)/4
+	top, bottom, left, right := 0, 0, 0, 0
+	for top < maxY && isBorder(x0, y0+top, 1, 0, x1-x0) {
+		top++
+	}
+	for bottom < maxY && isBorder(x0, y1-1-bottom, 1, 0, x1-x0) {
+		bottom++
+	}
+	for left < maxX && isBorder(x0+left, y0, 0, 1, y1-y0) {
+		left++
+	}
+	for right < maxX && isBorder(x1-1-right, y0, 0, 1, y1-y0) {
+		right++
+	}
+	return [4]int{x0 + left, y0 + top, x1 - right, y1 - bottom}
+}
+
+// centerCrop returns the largest centered part of a region with the given width to height ratio
+func centerCrop(region [4]int, aspect float64) [4]int {
+	width, height := region[2]-region[0], region[3]-region[1]
+	if float64(width) > aspect*float64(height) {
+		cropped := max(1, int(math.Round(aspect*float64(height))))
+		x0 := region[0] + (width-cropped)/2
+		return [4]int{x0, region[1], x0 + cropped, region[3]}
+	}
+	cropped := max(1, int(math.Round(float64(width)/aspect)))
+	y0 := region[1] + (height-cropped)/2
+	return [4]int{region[0], y0, region[2], y0 + cropped}
+}
+
+// letterbox pads a region to the given width to height ratio with its mean intensity, so the
+// padding adds as little contrast as possible. It returns the padded image and its full region.
+func letterbox(g grayGrid, region [4]int, aspect float64) (grayGrid, [4]int) {
+	width, height := region[2]-region[0], region[3]-region[1]
+	paddedWidth, paddedHeight := width, height
+	if float64(width) > aspect*float64(height) {
+		paddedHeight = max(height, int(math.Round(float64(width)/aspect)))
+	} else {
+		paddedWidth = max(width, int(math.Round(aspect*float64(height))))
+	}
+
+	var mean float64
+	for y := region[1]; y < region[3]; y++ {
+		for x := region[0]; x < region[2]; x++ {
+			mean += g.at(x, y)
+		}
+	}
+	mean /= float64(width * height)
+
+	padded := grayGrid{width: paddedWidth, height: paddedHeight, pix: make([]float64, paddedWidth*paddedHeight)}
+	offsetX, offsetY := (paddedWidth-width)/2, (paddedHeight-height)/2
+	for y := 0; y < paddedHeight; y++ {
+		for x := 0; x < paddedWidth; x++ {
+			sx, sy := x-offsetX, y-offsetY
+			if sx >= 0 && sx < width && sy >= 0 && sy < height {
+				padded.pix[y*paddedWidth+x] = g.at(region[0]+sx, region[1]+sy)
+			} else {
+				padded.pix[y*paddedWidth+x] = mean
+			}
+		}
+	}
+	return padded, [4]int{0, 0, paddedWidth, paddedHeight}
+}
+
+// resampleGray resizes a region of a grid to width by height and flattens it row by row
+func resampleGray(g grayGrid, region [4]int, width, height int, method string) []float64 {
+	regionWidth, regionHeight := region[2]-region[0], region[3]-region[1]
+	flattened := make([]float64, width*height)
+
+	kernel, ok := resampleKernels[method]
+	if !ok {
+		// Nearest neighbour, sampling the top-left source pixel of every target pixel
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				flattened[y*width+x] = g.at(region[0]+x*regionWidth/width, region[1]+y*regionHeight/height)
+			}
+		}
+		return flattened
+	}
+
+	// Resample separably, rows first, then columns
+	columnWeights := resampleWeights(regionWidth, width, kernel.support, kernel.weight)
+	rowWeights := resampleWeights(regionHeight, height, kernel.support, kernel.weight)
+
+	rows := make([]float64, regionHeight*width)
+	for y := 0; y < regionHeight; y++ {
+		for x, taps := range columnWeights {
+			var sum float64
+			for _, tap := range taps {
+				sum += tap.weight * g.at(region[0]+tap.index, region[1]+y)
+			}
+			rows[y*width+x] = sum
+		}
+	}
+	for y, taps := range rowWeights {
+		for x := 0; x < width; x++ {
+			var sum float64
+			for _, tap := range taps {
+				sum += tap.weight * rows[tap.index*width+x]
+			}
+			flattened[y*width+x] = math.Max(0, math.Min(255, sum))
+		}
+	}
+	return flattened
+}
+
+// resampleTap is the weight of one source pixel in a target pixel
+type resampleTap struct {
+	index  int
+	weight float64
+}
+
+// resampleWeights returns the taps of every target pixel when resizing from source to target
+// pixels. When shrinking, the kernel is widened by the scale so every source pixel counts.
+func resampleWeights(source, target int, support float64, kernel func(float64) float64) [][]resampleTap {
+	scale := float64(source) / float64(target)
+	stretch := math.Max(1, scale)
+	weights := make([][]resampleTap, target)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := int(math.Floor(center - support*stretch))
+		last := int(math.Ceil(center + support*stretch))
+
+		var total float64
+		for j := first; j <= last; j++ {
+			weight := kernel((float64(j) - center) / stretch)
+			if weight == 0 {
+				continue
+			}
+			// Edges repeat the outermost pixel
+			index := max(0, min(j, source-1))
+			weights[i] = append(weights[i], resampleTap{index: index, weight: weight})
+			total += weight
+		}
+		for k := range weights[i] {
+			weights[i][k].weight /= total
+		}
+	}
+	return weights
+}
@@ -0,0 +1,44 @@
+// interval_ngram_helpers.go builds the quantized pitch-interval n-grams used by the humming candidate index
+package helpers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// intervalClasses maps an absolute interval in semitones to its quantized class. Small
+// intervals keep their own class while large leaps, which humming gets wrong most often,
+// share wider ones.
+var intervalClasses = []int{0, 1, 2, 3, 3, 4, 5, 5, 6, 6, 6, 6, 6}
+
+// QuantizeInterval maps a signed interval in semitones to a signed interval class
+func QuantizeInterval(semitones int) int {
+	class := 7
+	if abs(semitones) < len(intervalClasses) {
+		class = intervalClasses[abs(semitones)]
+	}
+	if semitones < 0 {
+		return -class
+	}
+	return class
+}
+
+// IntervalNgram is one quantized interval n-gram and the note index where it starts
+type IntervalNgram struct {
+	Gram   string
+	Offset int
+}
+
+// BuildIntervalNgrams returns every quantized interval n-gram of the pitches in order.
+// An n-gram spans n+1 notes, so it is transposition invariant.
+func BuildIntervalNgrams(pitches []int, n int) []IntervalNgram {
+	var ngrams []IntervalNgram
+	for i := 0; i+n < len(pitches); i++ {
+		parts := make([]string, n)
+		for j := 0; j < n; j++ {
+			parts[j] = strconv.Itoa(QuantizeInterval(pitches[i+j+1] - pitches[i+j]))
+		}
+		ngrams = append(ngrams, IntervalNgram{Gram: strings.Join(parts, ","), Offset: i})
+	}
+	return ngrams
+}
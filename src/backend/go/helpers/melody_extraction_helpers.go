@@ -0,0 +1,159 @@
+// melody_extraction_helpers.go reduces polyphonic multi-track note lists to a single melody line
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrInvalidMelodyTrack is returned when a manually chosen melody track cannot be used
+var ErrInvalidMelodyTrack = errors.New("invalid melody track")
+
+const (
+	percussionChannel = 9    // MIDI channel 10, zero based
+	chordTolerance    = 0.03 // onsets closer than this, in seconds, sound together
+	minMelodyNotes    = 8    // parts with fewer notes are only picked when nothing else is left
+)
+
+// melodyPart is one instrument line, identified by its track and channel
+type melodyPart struct {
+	track   int
+	channel int
+}
+
+// ExtractMelody drops percussion, picks a part and reduces it to its top voice. A track of
+// -1 picks the most melodic track and channel automatically, any other value uses every
+// pitched note of that track. It returns the melody and the track it was taken from, or -1
+// when the notes carry no timing and are returned as they are.
+func ExtractMelody(notes []NoteEvent, track int) ([]NoteEvent, int, error) {
+	var pitched []NoteEvent
+	for _, note := range notes {
+		if note.Channel != percussionChannel {
+			pitched = append(pitched, note)
+		}
+	}
+
+	// Without onsets there is nothing to tell simultaneous notes apart
+	if !HasTiming(pitched) {
+		if track >= 0 {
+			return nil, -1, fmt.Errorf("%w: notes carry no timing to separate tracks", ErrInvalidMelodyTrack)
+		}
+		return pitched, -1, nil
+	}
+
+	if track >= 0 {
+		var selected []NoteEvent
+		for _, note := range pitched {
+			if note.Track == track {
+				selected = append(selected, note)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, -1, fmt.Errorf("%w: track %d has no pitched notes", ErrInvalidMelodyTrack, track)
+		}
+		return Skyline(selected), track, nil
+	}
+
+	parts := map[melodyPart][]NoteEvent{}
+	songEnd := 0.0
+	for _, note := range pitched {
+		part := melodyPart{track: note.Track, channel: note.Channel}
+		parts[part] = append(parts[part], note)
+		songEnd = math.Max(songEnd, note.Onset+note.Duration)
+	}
+
+	var best melodyPart
+	bestScore := math.Inf(-1)
+	for part, partNotes := range parts {
+		score := melodicScore(partNotes, songEnd)
+		// Prefer longer parts over tiny fills and the lower track/channel on ties, so the
+		// choice does not depend on map order
+		if len(partNotes) < minMelodyNotes {
+			score -= 1
+		}
+		if score > bestScore || (score == bestScore && (part.track < best.track ||
+			(part.track == best.track && part.channel < best.channel))) {
+			best, bestScore = part, score
+		}
+	}
+	return Skyline(parts[best]), best.track, nil
+}
+
+// Skyline keeps the highest of simultaneous notes and drops notes that start under a
+// higher note that is still sounding. Held notes are cut when a higher note takes over.
+func Skyline(notes []NoteEvent) []NoteEvent {
+	sorted := append([]NoteEvent(nil), notes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Onset != sorted[j].Onset {
+			return sorted[i].Onset < sorted[j].Onset
+		}
+		return sorted[i].Pitch > sorted[j].Pitch
+	})
+
+	melody := []NoteEvent{}
+	for _, note := range sorted {
+		if n := len(melody); n > 0 {
+			last := &melody[n-1]
+			// Part of the same chord, keep the top note
+			if note.Onset-last.Onset < chordTolerance {
+				if note.Pitch > last.Pitch {
+					*last = note
+				}
+				continue
+			}
+			// Starts while the previous note still sounds
+			if note.Onset < last.Onset+last.Duration {
+				if note.Pitch < last.Pitch {
+					continue
+				}
+				last.Duration = note.Onset - last.Onset
+			}
+		}
+		melody = append(melody, note)
+	}
+	return melody
+}
+
+// melodicScore rates how much a part looks like a melody: mostly single notes, moving in
+// small steps, in a middle-high register, with some variety and present through the song
+func melodicScore(notes []NoteEvent, songEnd float64) float64 {
+	if len(notes) == 0 {
+		return 0
+	}
+	line := Skyline(notes)
+
+	// Share of notes that are not stacked on another note
+	monophony := float64(len(line)) / float64(len(notes))
+
+	// Share of small melodic steps, repeated notes count half
+	stepwise := 0.0
+	for i := 1; i < len(line); i++ {
+		switch interval := abs(line[i].Pitch - line[i-1].Pitch); {
+		case interval == 0:
+			stepwise += 0.5
+		case interval <= 5:
+			stepwise++
+		}
+	}
+	if len(line) > 1 {
+		stepwise /= float64(len(line) - 1)
+	}
+
+	var pitchSum, covered float64
+	distinct := map[int]bool{}
+	for _, note := range line {
+		pitchSum += float64(note.Pitch)
+		covered += note.Duration
+		distinct[note.Pitch] = true
+	}
+	register := math.Max(0, math.Min(1, (pitchSum/float64(len(line))-48)/31))
+	coverage := 0.0
+	if songEnd > 0 {
+		coverage = math.Min(1, covered/songEnd)
+	}
+	variety := math.Min(1, float64(len(distinct))/5)
+
+	return 0.25*monophony + 0.25*stepwise + 0.2*register + 0.2*coverage + 0.1*variety
+}
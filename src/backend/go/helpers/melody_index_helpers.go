@@ -0,0 +1,191 @@
+// melody_index_helpers.go builds the precomputed melody features stored per song and scores queries against them
+package helpers
+
+import (
+	"bos/pablo/types"
+)
+
+// FeatureParams controls how the melody feature index is built. Bump Version whenever
+// any other field changes so the reindex command knows which songs are outdated.
+type FeatureParams struct {
+	Version       int
+	WindowSizes   []int // window lengths in notes
+	StrideDivisor int   // windows start every WindowSize/StrideDivisor notes
+	IntervalNgram int   // intervals per n-gram in the candidate index
+}
+
+// DefaultFeatureParams are the parameters used at ingest time and by the reindex command
+var DefaultFeatureParams = FeatureParams{
+	Version:       4,
+	WindowSizes:   []int{8, 16, 32},
+	StrideDivisor: 4,
+	IntervalNgram: 3,
+}
+
+// Stride returns the distance in notes between consecutive windows of the given size
+func (p FeatureParams) Stride(windowSize int) int {
+	return max(1, windowSize/max(1, p.StrideDivisor))
+}
+
+// NearestWindowSize picks the indexed window size closest to the query length
+func (p FeatureParams) NearestWindowSize(queryLength int) int {
+	best := p.WindowSizes[0]
+	for _, size := range p.WindowSizes[1:] {
+		if abs(size-queryLength) < abs(best-queryLength) {
+			best = size
+		}
+	}
+	return best
+}
+
+// BuildFeatureWindows computes the ATB/RTB/FTB histograms of every window of the song, plus
+// the rhythm histogram when the notes carry timing. Songs shorter than the window produce a
+// single window over all of their notes.
+func BuildFeatureWindows(notes []NoteEvent, windowSize, stride int) []types.FeatureWindow {
+	if len(notes) == 0 {
+		return []types.FeatureWindow{}
+	}
+	timed := HasTiming(notes)
+	if len(notes) <= windowSize {
+		return []types.FeatureWindow{newFeatureWindow(notes, 0, timed)}
+	}
+
+	var windows []types.FeatureWindow
+	for offset := 0; offset+windowSize <= len(notes); offset += stride {
+		windows = append(windows, newFeatureWindow(notes[offset:offset+windowSize], offset, timed))
+	}
+	// Make sure the tail of the song is covered
+	if last := len(notes) - windowSize; windows[len(windows)-1].Offset != last {
+		windows = append(windows, newFeatureWindow(notes[last:], last, timed))
+	}
+	return windows
+}
+
+func newFeatureWindow(notes []NoteEvent, offset int, timed bool) types.FeatureWindow {
+	pitches := Pitches(notes)
+	window := types.FeatureWindow{
+		Offset: offset,
+		ATB:    types.NewSparseHistogram(computeATB(pitches)),
+		RTB:    types.NewSparseHistogram(computeRTB(pitches)),
+		FTB:    types.NewSparseHistogram(computeFTB(pitches)),
+	}
+	if timed {
+		window.Onset = notes[0].Onset
+		window.IOI = types.NewSparseHistogram(computeIOIHistogram(notes))
+	}
+	return window
+}
+
+// ScoreFeatureWindows scores a query against the precomputed windows of a song and returns
+// the best window as a match. windowSize and noteCount bound the aligned song range.
+func ScoreFeatureWindows(query []NoteEvent, windows []types.FeatureWindow, windowSize, noteCount int, params MelodyParams) MelodyMatch {
+	histogram := func(h types.SparseHistogram) types.SparseHistogram {
+		if params.Normalize {
+			return normalizeSparseHistogram(h)
+		}
+		return h
+	}
+
+	queryPitches := Pitches(query)
+	queryATB := histogram(types.NewSparseHistogram(computeATB(queryPitches)))
+	queryRTB := histogram(types.NewSparseHistogram(computeRTB(queryPitches)))
+	queryFTB := histogram(types.NewSparseHistogram(computeFTB(queryPitches)))
+
+	var queryIOI types.SparseHistogram
+	if HasTiming(query) {
+		queryIOI = types.NewSparseHistogram(computeIOIHistogram(query))
+	}
+
+	// Cosine works on the sparse histograms directly, other metrics on their dense form
+	metric := params.similarityMetric()
+	compare := func(a, b types.SparseHistogram, bins int) float64 {
+		if metric.Name == "cosine" {
+			return sparseCosineSimilarity(a, b)
+		}
+		return metric.Similarity(a.Dense(bins), b.Dense(bins))
+	}
+
+	var best MelodyMatch
+	for i, window := range windows {
+		features := map[string]float64{
+			"atb": compare(queryATB, histogram(window.ATB), atbBins),
+			"rtb": compare(queryRTB, histogram(window.RTB), rtbBins),
+			"ftb": compare(queryFTB, histogram(window.FTB), ftbBins),
+		}
+		score := params.Weights.combine(features["atb"], features["rtb"], features["ftb"])
+		// Rhythm only contributes when both sides know when their notes start
+		if queryIOI != nil && window.IOI != nil {
+			features["rhythm"] = compare(queryIOI, window.IOI, ioiBins)
+			score = (1-rhythmWeight)*score + rhythmWeight*features["rhythm"]
+		}
+		if i > 0 && score <= best.Score {
+			continue
+		}
+
+		best = MelodyMatch{
+			Score:     score,
+			Offset:    window.Offset,
+			Features:  features,
+			SongRange: [2]int{window.Offset, min(window.Offset+windowSize, noteCount)},
+		}
+		if window.IOI != nil {
+			onset := window.Onset
+			best.OffsetSeconds = &onset
+		}
+	}
+	return best
+}
+
+// WindowsWithStep thins out windows so that consecutive ones start at least step notes apart
+func WindowsWithStep(windows []types.FeatureWindow, step int) []types.FeatureWindow {
+	if step <= 1 || len(windows) == 0 {
+		return windows
+	}
+	kept := []types.FeatureWindow{windows[0]}
+	for _, window := range windows[1:] {
+		if window.Offset-kept[len(kept)-1].Offset >= step {
+			kept = append(kept, window)
+		}
+	}
+	return kept
+}
+
+// normalizeSparseHistogram returns a copy of the histogram scaled so its bins sum to 1
+func normalizeSparseHistogram(h types.SparseHistogram) types.SparseHistogram {
+	total := 0.0
+	for _, value := range h {
+		total += value
+	}
+	if total == 0 {
+		return h
+	}
+	normalized := make(types.SparseHistogram, len(h))
+	for bin, value := range h {
+		normalized[bin] = value / total
+	}
+	return normalized
+}
+
+func sparseCosineSimilarity(a, b types.SparseHistogram) float64 {
+	normA, normB := a.Norm(), b.Norm()
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	// Iterate over the smaller histogram
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	var dot float64
+	for i, value := range a {
+		dot += value * b[i]
+	}
+	return dot / (normA * normB)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
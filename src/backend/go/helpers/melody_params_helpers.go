@@ -0,0 +1,213 @@
+// melody_params_helpers.go contains the tunable parameters of the histogram melody matcher and their validation
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MelodyWeights are the relative weights of the ATB, RTB and FTB similarities. They are
+// scaled to sum to 1 when combined, so the score stays in [0, 1].
+type MelodyWeights struct {
+	ATB float64 `json:"atb"`
+	RTB float64 `json:"rtb"`
+	FTB float64 `json:"ftb"`
+}
+
+// combine returns the weighted mean of the per-histogram similarities
+func (w MelodyWeights) combine(atbSim, rtbSim, ftbSim float64) float64 {
+	total := w.ATB + w.RTB + w.FTB
+	if total == 0 {
+		return 0
+	}
+	return (w.ATB*atbSim + w.RTB*rtbSim + w.FTB*ftbSim) / total
+}
+
+// MelodyParams controls how hummings are scored and which results are returned
+type MelodyParams struct {
+	Weights           MelodyWeights `json:"weights"`
+	WindowMultipliers []float64     `json:"windowMultipliers"` // song window lengths relative to the query length
+	WindowStep        int           `json:"windowStep"`        // notes between consecutive song windows
+	Normalize         bool          `json:"normalize"`         // scale histograms to sum to 1 before comparing
+	MinScore          float64       `json:"minScore"`          // only results scoring above this are returned
+	TopK              int           `json:"topK"`              // maximum number of results
+	Metric            string        `json:"metric"`            // name of the histogram similarity metric
+}
+
+// DefaultMelodyParams are used for every parameter a request does not set. main overrides
+// them from the MELODY_* environment variables at startup.
+var DefaultMelodyParams = MelodyParams{
+	Weights:           MelodyWeights{ATB: 0.05, RTB: 0.55, FTB: 0.40},
+	WindowMultipliers: []float64{1},
+	WindowStep:        1,
+	Normalize:         false,
+	MinScore:          0,
+	TopK:              9,
+	Metric:            "cosine",
+}
+
+// Limits enforced by Validate
+const (
+	maxWindowMultipliers = 8
+	minWindowMultiplier  = 0.25
+	maxWindowMultiplier  = 4.0
+	maxWindowStep        = 64
+	maxTopK              = 100
+)
+
+// LoadMelodyParamsFromEnv replaces DefaultMelodyParams with the values of MELODY_WEIGHT_ATB,
+// MELODY_WEIGHT_RTB, MELODY_WEIGHT_FTB, MELODY_WINDOW_MULTIPLIERS, MELODY_WINDOW_STEP,
+// MELODY_NORMALIZE, MELODY_MIN_SCORE, MELODY_TOP_K and MELODY_METRIC. Unset or empty variables keep their default.
+func LoadMelodyParamsFromEnv() error {
+	params, err := ParseMelodyParams(DefaultMelodyParams, func(key string) (string, bool) {
+		return os.LookupEnv("MELODY_" + strings.ToUpper(key))
+	})
+	if err != nil {
+		return err
+	}
+	DefaultMelodyParams = params
+	return nil
+}
+
+// ParseMelodyParams overrides base with the parameters returned by get and validates the result.
+// Keys are weight_atb, weight_rtb, weight_ftb, window_multipliers (comma separated),
+// window_step, normalize, min_score, top_k and metric.
+func ParseMelodyParams(base MelodyParams, get func(key string) (string, bool)) (MelodyParams, error) {
+	params := base
+	params.WindowMultipliers = append([]float64(nil), base.WindowMultipliers...)
+
+	lookup := func(key string) (string, bool) {
+		value, ok := get(key)
+		value = strings.TrimSpace(value)
+		return value, ok && value != ""
+	}
+	parseFloat := func(key string, target *float64) error {
+		if value, ok := lookup(key); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", key, value)
+			}
+			*target = parsed
+		}
+		return nil
+	}
+	parseInt := func(key string, target *int) error {
+		if value, ok := lookup(key); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer, got %q", key, value)
+			}
+			*target = parsed
+		}
+		return nil
+	}
+
+	for key, target := range map[string]*float64{
+		"weight_atb": &params.Weights.ATB,
+		"weight_rtb": &params.Weights.RTB,
+		"weight_ftb": &params.Weights.FTB,
+		"min_score":  &params.MinScore,
+	} {
+		if err := parseFloat(key, target); err != nil {
+			return base, err
+		}
+	}
+	for key, target := range map[string]*int{
+		"window_step": &params.WindowStep,
+		"top_k":       &params.TopK,
+	} {
+		if err := parseInt(key, target); err != nil {
+			return base, err
+		}
+	}
+
+	if value, ok := lookup("normalize"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return base, fmt.Errorf("normalize must be true or false, got %q", value)
+		}
+		params.Normalize = parsed
+	}
+
+	if value, ok := lookup("metric"); ok {
+		params.Metric = value
+	}
+
+	if value, ok := lookup("window_multipliers"); ok {
+		params.WindowMultipliers = nil
+		for _, part := range strings.Split(value, ",") {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return base, fmt.Errorf("window_multipliers must be comma separated numbers, got %q", value)
+			}
+			params.WindowMultipliers = append(params.WindowMultipliers, parsed)
+		}
+	}
+
+	if err := params.Validate(); err != nil {
+		return base, err
+	}
+	return params, nil
+}
+
+// Validate checks that every parameter is within its supported range
+func (p MelodyParams) Validate() error {
+	weights := []float64{p.Weights.ATB, p.Weights.RTB, p.Weights.FTB}
+	for _, weight := range weights {
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("weights must be finite and non-negative")
+		}
+	}
+	if p.Weights.ATB+p.Weights.RTB+p.Weights.FTB == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+
+	if len(p.WindowMultipliers) == 0 || len(p.WindowMultipliers) > maxWindowMultipliers {
+		return fmt.Errorf("window_multipliers must have between 1 and %d values", maxWindowMultipliers)
+	}
+	for _, multiplier := range p.WindowMultipliers {
+		if !(multiplier >= minWindowMultiplier && multiplier <= maxWindowMultiplier) {
+			return fmt.Errorf("window multipliers must be between %g and %g", minWindowMultiplier, maxWindowMultiplier)
+		}
+	}
+
+	if p.WindowStep < 1 || p.WindowStep > maxWindowStep {
+		return fmt.Errorf("window_step must be between 1 and %d", maxWindowStep)
+	}
+	if !(p.MinScore >= 0 && p.MinScore < 1) {
+		return fmt.Errorf("min_score must be at least 0 and below 1")
+	}
+	if p.TopK < 1 || p.TopK > maxTopK {
+		return fmt.Errorf("top_k must be between 1 and %d", maxTopK)
+	}
+	if _, err := LookupMetric(p.Metric); err != nil {
+		return err
+	}
+	return nil
+}
+
+// similarityMetric returns the configured metric, falling back to cosine for an unknown name
+func (p MelodyParams) similarityMetric() SimilarityMetric {
+	metric, err := LookupMetric(p.Metric)
+	if err != nil {
+		return similarityMetrics["cosine"]
+	}
+	return metric
+}
+
+// WindowSizes returns the distinct song window lengths for a query of queryLength notes
+func (p MelodyParams) WindowSizes(queryLength int) []int {
+	var sizes []int
+	seen := map[int]bool{}
+	for _, multiplier := range p.WindowMultipliers {
+		size := max(2, int(math.Round(multiplier*float64(queryLength))))
+		if !seen[size] {
+			seen[size] = true
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
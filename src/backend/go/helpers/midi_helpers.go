@@ -1,73 +1,228 @@
 package helpers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
-func ConvertToMidi(audioPath string) (string, string, error) {
-	// ext := strings.ToLower(filepath.Ext(audioPath))
+// ErrCircuitOpen is returned while the converter service is considered down
+var ErrCircuitOpen = errors.New("converter service unavailable, circuit breaker is open")
 
-	// URL of the external FastAPI service
-	apiURL := "http://127.0.0.1:8000/convert-to-midi/"
+// HTTPConverter streams files to the FastAPI converter service and stores the MIDI file
+// and notes it returns through Storage, so the service does not need access to our disk
+type HTTPConverter struct {
+	BaseURL    string
+	Storage    Storage
+	MaxRetries int           // extra attempts after the first one
+	Backoff    time.Duration // delay before the first retry, doubled on every retry
 
-	// Prepare the request payload using json.Marshal to handle escaping automatically
-	payload := map[string]string{"file_path": audioPath}
-	requestBody, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal request body: %v\n", err)
-		return "", "", fmt.Errorf("failed to marshal request body: %w", err)
+	client  *http.Client
+	breaker *circuitBreaker
+}
+
+// NewHTTPConverter creates a converter for the service at baseURL, e.g. http://127.0.0.1:8000.
+// Each attempt is bounded by timeout; after 5 consecutive failures requests fail fast for 30s.
+func NewHTTPConverter(baseURL string, storage Storage, timeout time.Duration, maxRetries int) *HTTPConverter {
+	return &HTTPConverter{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Storage:    storage,
+		MaxRetries: maxRetries,
+		Backoff:    500 * time.Millisecond,
+		client:     &http.Client{Timeout: timeout},
+		breaker:    &circuitBreaker{threshold: 5, cooldown: 30 * time.Second},
+	}
+}
+
+// Convert asks the service to convert audioPath, retrying transient failures with backoff
+func (h *HTTPConverter) Convert(ctx context.Context, audioPath string) (string, string, error) {
+	if !h.breaker.allow() {
+		return "", "", ErrCircuitOpen
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= h.MaxRetries; attempt++ {
+		if attempt > 0 {
+			// Exponential backoff with up to 50% jitter
+			delay := h.Backoff << (attempt - 1)
+			delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+			select {
+			case <-ctx.Done():
+				h.breaker.abandon()
+				return "", "", ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		midiPath, jsonPath, retryable, err := h.convertOnce(ctx, audioPath)
+		if err == nil {
+			h.breaker.record(true)
+			log.Printf("MIDI conversion successful, full path: %s\n", midiPath)
+			return midiPath, jsonPath, nil
+		}
+
+		lastErr = err
+		log.Printf("MIDI conversion attempt %d/%d failed: %v\n", attempt+1, h.MaxRetries+1, err)
+		if !retryable {
+			break
+		}
 	}
 
-	// Create the HTTP request
-	req, err := http.NewRequest("POST", apiURL, strings.NewReader(string(requestBody)))
+	// A cancelled request says nothing about the service
+	if ctx.Err() != nil {
+		h.breaker.abandon()
+		return "", "", lastErr
+	}
+	h.breaker.record(false)
+	return "", "", lastErr
+}
+
+// convertOnce performs a single request. The boolean reports whether the failure is worth retrying.
+func (h *HTTPConverter) convertOnce(ctx context.Context, audioPath string) (string, string, bool, error) {
+	file, err := os.Open(audioPath)
 	if err != nil {
-		log.Printf("Failed to create HTTP request: %v\n", err)
-		return "", "", fmt.Errorf("failed to create HTTP request: %w", err)
+		return "", "", false, err
 	}
+	defer file.Close()
 
-	req.Header.Set("Content-Type", "application/json")
+	// Stream the file as multipart form data instead of buffering it in memory
+	bodyReader, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		part, err := form.CreateFormFile("file", filepath.Base(audioPath))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.BaseURL+"/convert-to-midi/", bodyReader)
+	if err != nil {
+		bodyReader.Close()
+		return "", "", false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := h.client.Do(req)
 	if err != nil {
-		log.Printf("Failed to send request to API: %v\n", err)
-		return "", "", fmt.Errorf("failed to send request to API: %w", err)
+		return "", "", ctx.Err() == nil, fmt.Errorf("failed to send request to API: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Read the response body
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Failed to read response body: %v\n", err)
-		return "", "", fmt.Errorf("failed to read response body: %w", err)
+		return "", "", true, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	// Print the response body to see its content
-	log.Printf("Response body: %s\n", string(respBody))
-
-	// Check the response status
+	// Server errors may be transient, client errors will fail the same way again
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("API returned non-200 status code: %d\n", resp.StatusCode)
-		return "", "", fmt.Errorf("API returned non-200 status code: %d", resp.StatusCode)
+		return "", "", resp.StatusCode >= 500, fmt.Errorf("API returned status %d: %s", resp.StatusCode, truncate(string(respBody), 200))
 	}
 
-	// Parse the response
+	// The MIDI file comes back base64 encoded, which encoding/json decodes into []byte
 	var response struct {
-		FullPath string `json:"full_path"`
-		JsonPath string `json:"json_file_path"`
+		Midi  []byte        `json:"midi"`
+		Notes NotesDocument `json:"notes"`
 	}
 	if err := json.Unmarshal(respBody, &response); err != nil {
-		log.Printf("Failed to parse API response: %v\n", err)
-		return "", "", fmt.Errorf("failed to parse API response: %w", err)
+		return "", "", false, fmt.Errorf("failed to parse API response: %w", err)
+	}
+
+	midiPath, jsonPath, err := h.store(audioPath, response.Midi, response.Notes)
+	return midiPath, jsonPath, false, err
+}
+
+// store saves the converted MIDI file and notes under midi/ in the backend storage
+func (h *HTTPConverter) store(audioPath string, midi []byte, notes NotesDocument) (string, string, error) {
+	baseName := strings.TrimSuffix(filepath.Base(audioPath), filepath.Ext(audioPath))
+	uniqueID := strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	midiPath, err := h.Storage.Save(fmt.Sprintf("midi/%s_%s.mid", baseName, uniqueID), midi)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store MIDI file: %w", err)
+	}
+
+	notes.Version = NotesFormatVersion
+	if notes.Notes == nil {
+		notes.Notes = []NoteEvent{}
+	}
+	notesData, err := json.Marshal(notes)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal notes: %w", err)
+	}
+	jsonPath, err := h.Storage.Save(fmt.Sprintf("midi/%s_%s_data.json", baseName, uniqueID), notesData)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store notes: %w", err)
+	}
+	return midiPath, jsonPath, nil
+}
+
+// circuitBreaker opens after threshold consecutive failures. Once cooldown has passed it is
+// half-open: a single trial request goes through while the others keep failing fast, and the
+// trial's outcome either closes the breaker or opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half-open trial request is in flight
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
 	}
+	b.trial = true
+	return true
+}
 
-	// Log the returned full path
-	log.Printf("MIDI conversion successful, full path: %s\n", response.FullPath)
-	return response.FullPath, response.JsonPath, nil
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon ends a request without an outcome, such as one cancelled by its caller, so a
+// half-open breaker lets the next trial through
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "..."
 }
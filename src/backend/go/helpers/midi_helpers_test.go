@@ -0,0 +1,178 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// convertedResponse is a converter service reply carrying a tiny MIDI file and two notes
+var convertedResponse = map[string]any{
+	"midi":  []byte("MThd"),
+	"notes": NotesDocument{Timed: true, Notes: []NoteEvent{{Pitch: 60, Duration: 0.5}, {Pitch: 62, Onset: 0.5, Duration: 0.5}}},
+}
+
+// newConverterServer answers /convert-to-midi/ with the status respond returns for the
+// request number, counting from 1, and a converted file when that status is 200
+func newConverterServer(t *testing.T, respond func(request int) int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/convert-to-midi/" {
+			t.Errorf("request to %s, want /convert-to-midi/", r.URL.Path)
+		}
+		if _, _, err := r.FormFile("file"); err != nil {
+			t.Errorf("request without a file: %v", err)
+		}
+		status := respond(int(requests.Add(1)))
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			json.NewEncoder(w).Encode(convertedResponse)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newTestConverter points a converter at server with millisecond backoff and storage in a
+// temporary folder, and returns it with the path of a file to convert
+func newTestConverter(t *testing.T, server *httptest.Server, maxRetries int) (*HTTPConverter, string) {
+	t.Helper()
+	dir := t.TempDir()
+	audioPath := filepath.Join(dir, "humming.mp3")
+	if err := os.WriteFile(audioPath, []byte("audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	converter := NewHTTPConverter(server.URL, LocalStorage{BaseDir: filepath.Join(dir, "storage")}, time.Second, maxRetries)
+	converter.Backoff = time.Millisecond
+	return converter, audioPath
+}
+
+func TestHTTPConverterRetriesServerErrors(t *testing.T) {
+	server, requests := newConverterServer(t, func(request int) int {
+		if request < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	converter, audioPath := newTestConverter(t, server, 2)
+
+	midiPath, jsonPath, err := converter.Convert(context.Background(), audioPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Fatalf("got %d requests, want 3", got)
+	}
+
+	if midi, err := os.ReadFile(midiPath); err != nil || string(midi) != "MThd" {
+		t.Fatalf("stored MIDI file = %q, %v", midi, err)
+	}
+	notes, err := LoadNotesFromJSON(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[1].Pitch != 62 {
+		t.Fatalf("stored notes = %v, want the two converted notes", notes)
+	}
+}
+
+func TestHTTPConverterGivesUpAfterMaxRetries(t *testing.T) {
+	server, requests := newConverterServer(t, func(int) int { return http.StatusInternalServerError })
+	converter, audioPath := newTestConverter(t, server, 2)
+
+	if _, _, err := converter.Convert(context.Background(), audioPath); err == nil {
+		t.Fatal("conversion should fail when every attempt fails")
+	}
+	if got := requests.Load(); got != 3 {
+		t.Fatalf("got %d requests, want 3", got)
+	}
+}
+
+func TestHTTPConverterDoesNotRetryClientErrors(t *testing.T) {
+	server, requests := newConverterServer(t, func(int) int { return http.StatusBadRequest })
+	converter, audioPath := newTestConverter(t, server, 2)
+
+	if _, _, err := converter.Convert(context.Background(), audioPath); err == nil {
+		t.Fatal("conversion should fail on a client error")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("got %d requests, want 1", got)
+	}
+}
+
+func TestHTTPConverterHalfOpenBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+
+	var healthy atomic.Bool
+	trialStarted := make(chan struct{}, 1)
+	releaseTrial := make(chan struct{})
+	server, requests := newConverterServer(t, func(request int) int {
+		if request == 3 {
+			// Hold the first trial so a concurrent request can hit the half-open breaker
+			trialStarted <- struct{}{}
+			<-releaseTrial
+		}
+		if healthy.Load() {
+			return http.StatusOK
+		}
+		return http.StatusInternalServerError
+	})
+	converter, audioPath := newTestConverter(t, server, 0)
+	converter.breaker = &circuitBreaker{threshold: 2, cooldown: cooldown}
+	ctx := context.Background()
+
+	// Two failures open the breaker, which then fails fast without calling the service
+	for i := 0; i < 2; i++ {
+		if _, _, err := converter.Convert(ctx, audioPath); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("attempt %d: got %v, want the service error", i+1, err)
+		}
+	}
+	if _, _, err := converter.Convert(ctx, audioPath); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v while open, want ErrCircuitOpen", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("got %d requests while open, want 2", got)
+	}
+
+	// After the cooldown a single trial goes through while other requests keep failing fast
+	time.Sleep(cooldown)
+	trialErr := make(chan error, 1)
+	go func() {
+		_, _, err := converter.Convert(ctx, audioPath)
+		trialErr <- err
+	}()
+	<-trialStarted
+	if _, _, err := converter.Convert(ctx, audioPath); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v during the trial, want ErrCircuitOpen", err)
+	}
+
+	// A failed trial opens the breaker for another cooldown
+	close(releaseTrial)
+	if err := <-trialErr; err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("trial got %v, want the service error", err)
+	}
+	if _, _, err := converter.Convert(ctx, audioPath); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after a failed trial, want ErrCircuitOpen", err)
+	}
+
+	// A successful trial closes it again
+	time.Sleep(cooldown)
+	healthy.Store(true)
+	if _, _, err := converter.Convert(ctx, audioPath); err != nil {
+		t.Fatalf("trial got %v, want success", err)
+	}
+	if _, _, err := converter.Convert(ctx, audioPath); err != nil {
+		t.Fatalf("got %v after a successful trial, want success", err)
+	}
+	if got := requests.Load(); got != 5 {
+		t.Fatalf("got %d requests, want 5", got)
+	}
+}
@@ -0,0 +1,184 @@
+// notes_json_helpers.go contains the versioned note-event format stored behind Song.MidiJSON
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// NotesFormatVersion is the current version of the note-event JSON format
+const NotesFormatVersion = 2
+
+// NotesDocument is the on-disk note-event format. Timed is false when the notes were
+// upgraded from a bare pitch array without a MIDI file to recover timing from.
+// Melody holds the melody line extracted from Notes, and is empty for hummings.
+type NotesDocument struct {
+	Version     int         `json:"version"`
+	Timed       bool        `json:"timed"`
+	Notes       []NoteEvent `json:"notes"`
+	Melody      []NoteEvent `json:"melody,omitempty"`
+	MelodyTrack *int        `json:"melodyTrack,omitempty"` // track the melody was taken from
+}
+
+// LoadNotesDocument reads a notes file in either the versioned or the legacy []int format.
+// The second return value reports whether the file used the legacy format.
+func LoadNotesDocument(filePath string) (*NotesDocument, bool, error) {
+	fileData, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Legacy files hold a bare JSON array of pitches
+	if trimmed := bytes.TrimSpace(fileData); len(trimmed) > 0 && trimmed[0] == '[' {
+		var pitches []int
+		if err := json.Unmarshal(trimmed, &pitches); err != nil {
+			return nil, false, err
+		}
+		return legacyNotesDocument(pitches), true, nil
+	}
+
+	var doc NotesDocument
+	if err := json.Unmarshal(fileData, &doc); err != nil {
+		return nil, false, err
+	}
+	if doc.Version > NotesFormatVersion {
+		return nil, false, fmt.Errorf("unsupported notes format version %d", doc.Version)
+	}
+	return &doc, false, nil
+}
+
+// LoadNotesFromJSON reads the note events of a notes file
+func LoadNotesFromJSON(filePath string) ([]NoteEvent, error) {
+	doc, _, err := LoadNotesDocument(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Notes, nil
+}
+
+// LoadMelodyFromJSON reads the extracted melody of a notes file, or all of its note events
+// when no melody was extracted
+func LoadMelodyFromJSON(filePath string) ([]NoteEvent, error) {
+	doc, _, err := LoadNotesDocument(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Melody) > 0 {
+		return doc.Melody, nil
+	}
+	return doc.Notes, nil
+}
+
+// ExtractMelodyToJSON extracts the melody of a notes file and stores it next to the full
+// note list. A track of -1 picks the melody track automatically.
+func ExtractMelodyToJSON(filePath string, track int) (*NotesDocument, error) {
+	doc, _, err := LoadNotesDocument(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	melody, melodyTrack, err := ExtractMelody(doc.Notes, track)
+	if err != nil {
+		return nil, err
+	}
+	doc.Version = NotesFormatVersion
+	doc.Melody = melody
+	doc.MelodyTrack = nil
+	if melodyTrack >= 0 {
+		doc.MelodyTrack = &melodyTrack
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notes: %w", err)
+	}
+	return doc, os.WriteFile(filePath, data, 0644)
+}
+
+// SaveNotesToJSON writes note events in the current versioned format
+func SaveNotesToJSON(filePath string, notes []NoteEvent, timed bool) error {
+	if notes == nil {
+		notes = []NoteEvent{}
+	}
+	data, err := json.Marshal(NotesDocument{Version: NotesFormatVersion, Timed: timed, Notes: notes})
+	if err != nil {
+		return fmt.Errorf("failed to marshal notes: %w", err)
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+// UpgradeNotesJSON rewrites a legacy pitch array file in place. Timing is recovered from
+// midiPath when it can be parsed, otherwise the pitches are kept without timing.
+// It reports whether the file was rewritten.
+func UpgradeNotesJSON(jsonPath, midiPath string) (bool, error) {
+	doc, legacy, err := LoadNotesDocument(jsonPath)
+	if err != nil {
+		return false, err
+	}
+	if !legacy {
+		return false, nil
+	}
+
+	if midiPath != "" {
+		if midi, err := ParseMidiFile(midiPath); err == nil {
+			return true, SaveNotesToJSON(jsonPath, midi.NoteEvents(), true)
+		}
+	}
+	return true, SaveNotesToJSON(jsonPath, doc.Notes, false)
+}
+
+// Pitches returns the pitch sequence of the note events
+func Pitches(notes []NoteEvent) []int {
+	pitches := make([]int, len(notes))
+	for i, note := range notes {
+		pitches[i] = note.Pitch
+	}
+	return pitches
+}
+
+// NotesFromPitches builds note events from MIDI pitches. When durations in seconds are
+// given, one per pitch, the notes are played back to back; otherwise they carry no timing.
+func NotesFromPitches(pitches []int, durations []float64) ([]NoteEvent, error) {
+	if len(durations) > 0 && len(durations) != len(pitches) {
+		return nil, fmt.Errorf("got %d durations for %d pitches", len(durations), len(pitches))
+	}
+
+	notes := make([]NoteEvent, len(pitches))
+	onset := 0.0
+	for i, pitch := range pitches {
+		if pitch < 0 || pitch > 127 {
+			return nil, fmt.Errorf("pitch %d is outside the MIDI range 0-127", pitch)
+		}
+		notes[i] = NoteEvent{Pitch: pitch, Velocity: 80}
+		if len(durations) > 0 {
+			if !(durations[i] > 0) {
+				return nil, fmt.Errorf("duration %g must be positive", durations[i])
+			}
+			notes[i].Onset, notes[i].Duration = onset, durations[i]
+			onset += durations[i]
+		}
+	}
+	return notes, nil
+}
+
+// HasTiming reports whether the note events carry usable onsets
+func HasTiming(notes []NoteEvent) bool {
+	for _, note := range notes {
+		if note.Onset > 0 || note.Duration > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyNotesDocument wraps the pitch array of a legacy notes file, which has no timing or
+// velocity, in the current format
+func legacyNotesDocument(pitches []int) *NotesDocument {
+	notes := make([]NoteEvent, len(pitches))
+	for i, pitch := range pitches {
+		notes[i] = NoteEvent{Pitch: pitch}
+	}
+	return &NotesDocument{Version: NotesFormatVersion, Timed: false, Notes: notes}
+}
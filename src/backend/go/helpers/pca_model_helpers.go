@@ -0,0 +1,154 @@
+// pca_model_helpers.go contains the eigen-album PCA model fitted over every album cover
+package helpers
+
+import (
+	"bos/pablo/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PCAModel is a principal component analysis of the flattened album covers. Covers are
+// compared by their projections on the components instead of pixel by pixel.
+type PCAModel struct {
+	ID                string      `json:"id"` // albums store the ID of the model their projection belongs to
+	CreatedAt         time.Time   `json:"createdAt"`
+	AlbumCount        int         `json:"albumCount"`
+	Mean              []float64   `json:"mean"`              // mean cover
+	Components        [][]float64 `json:"components"`        // unit eigen-albums, strongest first
+	Variance          []float64   `json:"variance"`          // variance along every component
+	ExplainedVariance []float64   `json:"explainedVariance"` // share of the total variance of every component
+	TypicalDistance   float64     `json:"typicalDistance"`   // expected distance between two covers in the reduced space
+}
+
+// FitPCAModel fits a model with up to k components to flattened images of equal size.
+//
+// With far fewer albums than pixels, the components are found from the eigenvectors of the
+// album-by-album Gram matrix of the centered images rather than from the pixel covariance.
+func FitPCAModel(vectors [][]float64, k int) (*PCAModel, error) {
+	n := len(vectors)
+	if n < 2 {
+		return nil, errors.New("at least 2 albums are needed to fit a PCA model")
+	}
+	dim := len(vectors[0])
+	for _, vector := range vectors {
+		if len(vector) != dim {
+			return nil, fmt.Errorf("image sizes differ: %d and %d pixels", dim, len(vector))
+		}
+	}
+	k = max(1, min(k, n-1))
+
+	// Center the images
+	centered, mean := types.NewMatrix(vectors).Center()
+
+	gram, err := centered.Multiply(centered.Transpose())
+	if err != nil {
+		return nil, err
+	}
+	var totalVariance float64
+	for i := 0; i < n; i++ {
+		totalVariance += gram.Get(i, i)
+	}
+	totalVariance /= float64(n - 1)
+
+	eigenvalues, eigenvectors, err := gram.SymmetricEigen()
+	if err != nil {
+		return nil, err
+	}
+
+	model := &PCAModel{
+		ID:         uuid.New().String(),
+		CreatedAt:  time.Now(),
+		AlbumCount: n,
+		Mean:       mean,
+	}
+	var captured float64
+	for c, eigenvalue := range eigenvalues[:k] {
+		if eigenvalue <= 1e-9 {
+			break
+		}
+		// u = Xc^T v / sqrt(lambda) is a unit eigenvector of the pixel covariance
+		component := make([]float64, dim)
+		for i, weight := range eigenvectors.Column(c) {
+			for j, value := range centered.GetRow(i) {
+				component[j] += weight * value
+			}
+		}
+		norm := math.Sqrt(eigenvalue)
+		for j := range component {
+			component[j] /= norm
+		}
+
+		variance := eigenvalue / float64(n-1)
+		model.Components = append(model.Components, component)
+		model.Variance = append(model.Variance, variance)
+		if totalVariance > 0 {
+			model.ExplainedVariance = append(model.ExplainedVariance, variance/totalVariance)
+		}
+		captured += variance
+	}
+	if len(model.Components) == 0 {
+		return nil, errors.New("the album covers do not vary")
+	}
+	model.TypicalDistance = math.Sqrt(2 * captured)
+	return model, nil
+}
+
+// Project returns the coordinates of a flattened image along the components
+func (m *PCAModel) Project(vector []float64) ([]float64, error) {
+	if len(vector) != len(m.Mean) {
+		return nil, fmt.Errorf("image has %d pixels, the PCA model expects %d", len(vector), len(m.Mean))
+	}
+	projection := make([]float64, len(m.Components))
+	for c, component := range m.Components {
+		for j, value := range vector {
+			projection[c] += (value - m.Mean[j]) * component[j]
+		}
+	}
+	return projection, nil
+}
+
+// Similarity maps the distance between two projections to [0, 1], 0 at the typical distance
+// between two covers of the collection
+func (m *PCAModel) Similarity(a, b []float64) float64 {
+	if len(a) != len(b) || m.TypicalDistance == 0 {
+		return 0
+	}
+	return math.Max(0, 1-euclideanDistance(a, b)/m.TypicalDistance)
+}
+
+// SavePCAModel writes a model to a JSON file
+func SavePCAModel(path string, model *PCAModel) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	// Write next to the old model and swap, so readers never see half a file
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// LoadPCAModel reads a model written by SavePCAModel
+func LoadPCAModel(path string) (*PCAModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var model PCAModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("invalid PCA model %s: %w", path, err)
+	}
+	return &model, nil
+}
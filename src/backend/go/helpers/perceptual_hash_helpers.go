@@ -0,0 +1,257 @@
+// perceptual_hash_helpers.go contains the average, difference and DCT perceptual hashes of album covers
+package helpers
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"slices"
+	"sort"
+)
+
+// ImageHashVersion changes whenever the hashes are computed differently, so stored hashes
+// of an older version are recomputed
+const ImageHashVersion = 1
+
+// ImageHashes are three 64-bit perceptual hashes of an image. Similar images have hashes
+// that differ in few bits.
+type ImageHashes struct {
+	Average    uint64 `json:"average"`    // aHash: 8x8 pixels brighter than their mean
+	Difference uint64 `json:"difference"` // dHash: 8x8 pixels brighter than their right neighbour
+	Perceptual uint64 `json:"perceptual"` // pHash: 8x8 lowest DCT frequencies above their median
+}
+
+// HashBits is the number of bits of every hash, the largest possible Hamming distance
+const HashBits = 64
+
+// Hash names accepted by ImageHashes.Get
+const (
+	HashAverage    = "average"
+	HashDifference = "difference"
+	HashPerceptual = "perceptual"
+)
+
+// Get returns the named hash
+func (h ImageHashes) Get(name string) (uint64, error) {
+	switch name {
+	case HashAverage:
+		return h.Average, nil
+	case HashDifference:
+		return h.Difference, nil
+	case HashPerceptual:
+		return h.Perceptual, nil
+	}
+	return 0, fmt.Errorf("unknown hash %q, expected %s, %s or %s", name, HashAverage, HashDifference, HashPerceptual)
+}
+
+// HashImageFile computes the perceptual hashes of an image file
+func HashImageFile(path string) (ImageHashes, error) {
+	img, err := loadImage(path)
+	if err != nil {
+		return ImageHashes{}, fmt.Errorf("error loading image from path %s: %w", path, err)
+	}
+	return HashImage(img), nil
+}
+
+// HashImage computes the perceptual hashes of an image
+func HashImage(img image.Image) ImageHashes {
+	gray := convertToGrayscale(img)
+	return ImageHashes{
+		Average:    averageHash(areaResize(gray, 8, 8)),
+		Difference: differenceHash(areaResize(gray, 9, 8), 9),
+		Perceptual: dctHash(areaResize(gray, 32, 32), 32),
+	}
+}
+
+// HammingDistance counts the bits in which two hashes differ
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func averageHash(pixels []float64) uint64 {
+	var mean float64
+	for _, value := range pixels {
+		mean += value / float64(len(pixels))
+	}
+	var hash uint64
+	for i, value := range pixels {
+		if value > mean {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
+
+// differenceHash compares every pixel with its right neighbour in rows of width pixels
+func differenceHash(pixels []float64, width int) uint64 {
+	var hash uint64
+	bit := 0
+	for y := 0; y < len(pixels)/width; y++ {
+		for x := 0; x < width-1; x++ {
+			if pixels[y*width+x] > pixels[y*width+x+1] {
+				hash |= 1 << bit
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+// dctHash keeps the signs of the 8x8 lowest frequencies of the DCT of a size by size image,
+// relative to the median of the frequencies other than the average brightness
+func dctHash(pixels []float64, size int) uint64 {
+	// Separable 2D DCT-II, rows then columns
+	basis := make([][]float64, 8)
+	for u := range basis {
+		basis[u] = make([]float64, size)
+		for x := range basis[u] {
+			basis[u][x] = math.Cos(math.Pi * float64(u) * (2*float64(x) + 1) / float64(2*size))
+		}
+	}
+	rows := make([][]float64, size) // rows[y][u]
+	for y := range rows {
+		rows[y] = make([]float64, 8)
+		for u := 0; u < 8; u++ {
+			for x := 0; x < size; x++ {
+				rows[y][u] += pixels[y*size+x] * basis[u][x]
+			}
+		}
+	}
+	coefficients := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			for y := 0; y < size; y++ {
+				coefficients[v*8+u] += rows[y][u] * basis[v][y]
+			}
+		}
+	}
+
+	ac := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(ac)
+	median := ac[len(ac)/2]
+
+	var hash uint64
+	for i, value := range coefficients {
+		if value > median {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
+
+// areaResize shrinks a grayscale image to width by height pixels, each the mean of the
+// source pixels it covers
+func areaResize(img *image.Gray, width, height int) []float64 {
+	bounds := img.Bounds()
+	pixels := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var sum float64
+			count := 0
+			for sy := y0; sy < y1 && sy < bounds.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < bounds.Max.X; sx++ {
+					sum += float64(img.GrayAt(sx, sy).Y)
+					count++
+				}
+			}
+			if count > 0 {
+				pixels[y*width+x] = sum / float64(count)
+			}
+		}
+	}
+	return pixels
+}
+
+// BKTree indexes hashes for lookups by Hamming distance. Every node keeps its children by
+// their distance to it, so by the triangle inequality a search within d of a hash at distance
+// k from a node only visits the children between k-d and k+d.
+type BKTree struct {
+	root *bkNode
+	size int
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []uint // albums sharing this exact hash
+	children map[int]*bkNode
+}
+
+// BKMatch is an ID found by a BK-tree search and the distance of its hash
+type BKMatch struct {
+	ID       uint
+	Distance int
+}
+
+// Len returns the number of IDs in the tree
+func (t *BKTree) Len() int {
+	return t.size
+}
+
+// Insert adds the hash of an ID. Inserting the same ID and hash again does nothing.
+func (t *BKTree) Insert(hash uint64, id uint) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, ids: []uint{id}}
+		t.size++
+		return
+	}
+	node := t.root
+	for {
+		distance := HammingDistance(node.hash, hash)
+		if distance == 0 {
+			if !slices.Contains(node.ids, id) {
+				node.ids = append(node.ids, id)
+				t.size++
+			}
+			return
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = map[int]*bkNode{}
+			}
+			node.children[distance] = &bkNode{hash: hash, ids: []uint{id}}
+			t.size++
+			return
+		}
+		node = child
+	}
+}
+
+// Search returns the IDs whose hash is within maxDistance of hash, closest first
+func (t *BKTree) Search(hash uint64, maxDistance int) []BKMatch {
+	var matches []BKMatch
+	stack := []*bkNode{}
+	if t.root != nil {
+		stack = append(stack, t.root)
+	}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := HammingDistance(node.hash, hash)
+		if distance <= maxDistance {
+			for _, id := range node.ids {
+				matches = append(matches, BKMatch{ID: id, Distance: distance})
+			}
+		}
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches
+}
@@ -3,41 +3,43 @@ package helpers
 
 import (
 	"bos/pablo/types"
+	"bytes"
 	"fmt"
 	"image"
 	"image/color"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"log"
 	"math"
 	"os"
+	"strings"
+
+	_ "golang.org/x/image/webp"
 )
 
 func CheckPictureSimilarity(uploadPictureFlattened []float64, albumPictureFlattened []float64) float64 {
-	// Load images into matrix
-	uploadPictureMatrix := types.NewMatrix([][]float64{uploadPictureFlattened})
-	albumPictureMatrix := types.NewMatrix([][]float64{albumPictureFlattened})
-
-	// Compute mean pixel
-	meanPixel := computeMeanPixel(types.NewMatrix([][]float64{uploadPictureFlattened, albumPictureFlattened}))
+	// Load images into matrix and center the data
+	pictures := types.NewMatrix([][]float64{uploadPictureFlattened, albumPictureFlattened})
+	centered, _ := pictures.Center()
 
-	// Center the data
-	meanPixelMatrix := types.NewMatrix([][]float64{meanPixel.GetRow(0)})
-	uploadPictureMatrix = subtractVector(uploadPictureMatrix, meanPixelMatrix)
-	albumPictureMatrix = subtractVector(albumPictureMatrix, meanPixelMatrix)
+	// Perform PCA, the right singular vectors of the centered images are the components
+	_, singularValues, components := centered.SVD()
 
-	// Perform PCA
-	components, _, err := randomizedSVD(types.NewMatrix([][]float64{uploadPictureFlattened, albumPictureFlattened}), 10)
+	// Project images to PCA space, keeping up to 10 components that carry variance
+	projected, err := centered.Multiply(components)
 	if err != nil {
-		log.Fatalf("Error performing PCA: %v", err)
+		log.Printf("Error performing PCA: %v", err)
 		return 0.0
 	}
-
-	pcaComponents := types.NewMatrix(components)
-
-	// Project images to PCA space
-	uploadPictureProjected := projectToPCASpace(uploadPictureMatrix, pcaComponents)
-	albumPictureProjected := projectToPCASpace(albumPictureMatrix, pcaComponents)
+	var uploadPictureProjected, albumPictureProjected []float64
+	for k := 0; k < min(10, len(singularValues)); k++ {
+		if singularValues[k] <= 1e-9 {
+			break
+		}
+		uploadPictureProjected = append(uploadPictureProjected, projected.Get(0, k))
+		albumPictureProjected = append(albumPictureProjected, projected.Get(1, k))
+	}
 
 	// Compute Euclidean distance
 	distance := euclideanDistance(uploadPictureProjected, albumPictureProjected)
@@ -50,28 +52,62 @@ func CheckPictureSimilarity(uploadPictureFlattened []float64, albumPictureFlatte
 	return similarity
 }
 
-func PreprocessImage(imagePath string, width, height int) ([]float64, error) {
-	// Load the image
-	pictureImg, err := loadImage(imagePath)
+// PictureMetricPCA names the default image metric, the PCA distance of CheckPictureSimilarity
+const PictureMetricPCA = "pca"
+
+// LookupPictureMetric checks that name can compare images. Metrics over ordered bins, such as
+// emd, are rejected because neighbouring pixels of a flattened image are not neighbouring values.
+func LookupPictureMetric(name string) error {
+	if name == PictureMetricPCA {
+		return nil
+	}
+	metric, err := LookupMetric(name)
 	if err != nil {
-		return nil, fmt.Errorf("error loading image from path %s: %w", imagePath, err)
+		return fmt.Errorf("unknown metric %q, expected %s or one of %s", name, PictureMetricPCA, strings.Join(MetricNames(), ", "))
 	}
-	// grayscale, resize, and flatten the image
-	pictureFlattened := flattenImage(resizeImage(convertToGrayscale(pictureImg), image.Point{X: width, Y: height}))
+	if metric.OrderedBins {
+		return fmt.Errorf("metric %q cannot compare images", name)
+	}
+	return nil
+}
 
-	return pictureFlattened, nil
+// CheckPictureSimilarityWithMetric compares two flattened images with the named metric. The
+// pca metric is CheckPictureSimilarity, the others compare the pixel intensities directly.
+func CheckPictureSimilarityWithMetric(uploadPictureFlattened, albumPictureFlattened []float64, metricName string) (float64, error) {
+	if err := LookupPictureMetric(metricName); err != nil {
+		return 0, err
+	}
+	if len(uploadPictureFlattened) != len(albumPictureFlattened) {
+		return 0, fmt.Errorf("image sizes differ: %d and %d pixels", len(uploadPictureFlattened), len(albumPictureFlattened))
+	}
+	if metricName == PictureMetricPCA {
+		return CheckPictureSimilarity(uploadPictureFlattened, albumPictureFlattened), nil
+	}
+	return similarityMetrics[metricName].Similarity(uploadPictureFlattened, albumPictureFlattened), nil
 }
 
 // Utility functions for image processing and math
+
+// loadImage decodes an image file. JPEG photos are turned upright by their EXIF orientation
+// when DefaultImagePreprocessing enables it.
 func loadImage(path string) (image.Image, error) {
-	file, err := os.Open(path)
+	return decodeImage(path, DefaultImagePreprocessing.ExifOrientation)
+}
+
+func decodeImage(path string, exifOrientation bool) (image.Image, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	img, _, err := image.Decode(file)
-	return img, err
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" && exifOrientation {
+		img = orientImage(img, jpegOrientation(data))
+	}
+	return img, nil
 }
 
 func convertToGrayscale(img image.Image) *image.Gray {
@@ -87,91 +123,6 @@ func convertToGrayscale(img image.Image) *image.Gray {
 	return gray
 }
 
-func resizeImage(img *image.Gray, size image.Point) *image.Gray {
-	resized := image.NewGray(image.Rect(0, 0, size.X, size.Y))
-	for y := 0; y < size.Y; y++ {
-		for x := 0; x < size.X; x++ {
-			srcX := x * img.Bounds().Dx() / size.X
-			srcY := y * img.Bounds().Dy() / size.Y
-			resized.Set(x, y, img.At(srcX, srcY))
-		}
-	}
-	return resized
-}
-
-func flattenImage(img *image.Gray) []float64 {
-	bounds := img.Bounds()
-	flattened := make([]float64, bounds.Dx()*bounds.Dy())
-	idx := 0
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			flattened[idx] = float64(img.GrayAt(x, y).Y)
-			idx++
-		}
-	}
-	return flattened
-}
-
-func computeMeanPixel(images *types.Matrix) *types.Matrix {
-	if images.Rows() == 0 {
-		return nil
-	}
-
-	pixelCount := images.Cols()
-	meanPixel := make([]float64, pixelCount)
-
-	for i := 0; i < images.Rows(); i++ {
-		row := images.GetRow(i)
-		for j := 0; j < pixelCount; j++ {
-			meanPixel[j] += row[j]
-		}
-	}
-
-	for j := 0; j < pixelCount; j++ {
-		meanPixel[j] /= float64(images.Rows())
-	}
-
-	return types.NewMatrix([][]float64{meanPixel})
-}
-
-func subtractVector(vec *types.Matrix, mean *types.Matrix) *types.Matrix {
-	if vec.Rows() == 0 || mean.Rows() == 0 {
-		return vec
-	}
-
-	meanRow := mean.GetRow(0)
-	result := make([][]float64, vec.Rows())
-
-	for i := 0; i < vec.Rows(); i++ {
-		row := vec.GetRow(i)
-		resultRow := make([]float64, len(row))
-		for j := range row {
-			resultRow[j] = row[j] - meanRow[j]
-		}
-		result[i] = resultRow
-	}
-
-	return types.NewMatrix(result)
-}
-
-func projectToPCASpace(vec *types.Matrix, components *types.Matrix) []float64 {
-	if vec.Rows() == 0 || components.Rows() == 0 {
-		return nil
-	}
-
-	// Ensure the projection works for a matrix, not just a slice
-	queryVec := vec.GetRow(0)
-	projectedVec := make([]float64, components.Cols())
-
-	for j := 0; j < components.Cols(); j++ {
-		for i := 0; i < components.Rows(); i++ {
-			projectedVec[j] += queryVec[i] * components.Get(i, j)
-		}
-	}
-
-	return projectedVec
-}
-
 func euclideanDistance(vec1, vec2 []float64) float64 {
 	var sumSquaredDiff float64
 	for i := range vec1 {
@@ -181,82 +132,6 @@ func euclideanDistance(vec1, vec2 []float64) float64 {
 	return math.Sqrt(sumSquaredDiff)
 }
 
-// Simplified SVD implementation using power iteration method
-func randomizedSVD(data *types.Matrix, k int) ([][]float64, []float64, error) {
-	if data.Rows() == 0 || data.Cols() == 0 {
-		return nil, nil, fmt.Errorf("empty data matrix")
-	}
-
-	rows, cols := data.Rows(), data.Cols()
-	k = min(k, min(rows, cols))
-
-	// Random initialization
-	components := make([][]float64, k)
-	singularValues := make([]float64, k)
-
-	for i := 0; i < k; i++ {
-		components[i] = make([]float64, cols)
-		// Random initialization
-		for j := range components[i] {
-			components[i][j] = math.Pow(-1, float64(i+j))
-		}
-
-		// Power iteration
-		for iter := 0; iter < 5; iter++ {
-			newComponent := make([]float64, cols)
-			for l := 0; l < rows; l++ {
-				for j := 0; j < cols; j++ {
-					newComponent[j] += data.Get(l, j) * components[i][j]
-				}
-			}
-
-			// Orthogonalize against previous components
-			for p := 0; p < i; p++ {
-				proj := dotProduct(newComponent, components[p])
-				for j := range newComponent {
-					newComponent[j] -= proj * components[p][j]
-				}
-			}
-
-			// Normalize
-			norm := vectorNorm(newComponent)
-			for j := range newComponent {
-				components[i][j] = newComponent[j] / norm
-			}
-		}
-
-		// Compute singular value
-		singularValues[i] = computeSingularValue(data.ToSlice(), components[i])
-	}
-
-	return components, singularValues, nil
-}
-
-func dotProduct(vec1, vec2 []float64) float64 {
-	var sum float64
-	for i := range vec1 {
-		sum += vec1[i] * vec2[i]
-	}
-	return sum
-}
-
-func vectorNorm(vec []float64) float64 {
-	var sumSquared float64
-	for _, v := range vec {
-		sumSquared += v * v
-	}
-	return math.Sqrt(sumSquared)
-}
-
-func computeSingularValue(data [][]float64, component []float64) float64 {
-	var maxVal float64
-	for _, row := range data {
-		val := dotProduct(row, component)
-		maxVal = math.Max(maxVal, math.Abs(val))
-	}
-	return maxVal
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
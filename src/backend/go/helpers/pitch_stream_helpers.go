@@ -0,0 +1,66 @@
+// pitch_stream_helpers.go contains the incremental pitch tracker behind streaming humming search
+package helpers
+
+import "math"
+
+// PitchStream tracks the pitch of audio arriving in chunks. Frames are analyzed as soon as
+// their samples have arrived, so the notes hummed so far can be read at any time.
+type PitchStream struct {
+	opts      PitchTrackerOptions
+	inputRate int
+	buffer    []float64 // resampled samples from the start of the next frame on
+	offset    int       // position of buffer[0] in the stream, in resampled samples
+	peak      float64   // loudest sample so far
+	frames    []PitchFrame
+	diff      []float64
+	minLag    int
+	maxLag    int
+}
+
+// NewPitchStream starts a stream of mono audio sampled at inputRate
+func NewPitchStream(inputRate int, opts PitchTrackerOptions) *PitchStream {
+	minLag, maxLag := pitchLags(opts)
+	return &PitchStream{
+		opts:      opts,
+		inputRate: inputRate,
+		diff:      make([]float64, maxLag+1),
+		minLag:    minLag,
+		maxLag:    maxLag,
+	}
+}
+
+// Write appends samples in [-1, 1] and analyzes every frame they complete. Chunks are
+// resampled one at a time, so streaming at the tracker's sample rate avoids seams.
+//
+// The batch tracker normalizes a recording by its loudest sample before gating silence; a
+// stream cannot look ahead, so frames are gated against the loudest sample heard so far.
+func (s *PitchStream) Write(samples []float64) {
+	samples = Resample(samples, s.inputRate, s.opts.SampleRate)
+	for _, sample := range samples {
+		s.peak = math.Max(s.peak, math.Abs(sample))
+	}
+	s.buffer = append(s.buffer, samples...)
+
+	gain := 1.0
+	if s.peak > 0 {
+		gain = 1 / s.peak
+	}
+	consumed := 0
+	for consumed+s.opts.FrameSize <= len(s.buffer) {
+		frame := s.buffer[consumed : consumed+s.opts.FrameSize]
+		s.frames = append(s.frames, analyzePitchFrame(frame, s.offset+consumed, s.diff, s.minLag, s.maxLag, gain, s.opts))
+		consumed += s.opts.HopSize
+	}
+	s.buffer = append([]float64(nil), s.buffer[consumed:]...)
+	s.offset += consumed
+}
+
+// Notes segments the frames analyzed so far into notes. The last note may still be growing.
+func (s *PitchStream) Notes() []NoteEvent {
+	return SegmentNotes(s.frames, s.opts)
+}
+
+// Duration returns the length of the audio received so far in seconds
+func (s *PitchStream) Duration() float64 {
+	return float64(s.offset+len(s.buffer)) / float64(s.opts.SampleRate)
+}
@@ -0,0 +1,267 @@
+// pitch_tracker_helpers.go contains a YIN-style monophonic pitch tracker that turns humming into note events
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// PitchTrackerOptions controls the native humming transcription
+type PitchTrackerOptions struct {
+	SampleRate      int     // audio is resampled to this rate before tracking
+	FrameSize       int     // analysis window in samples
+	HopSize         int     // distance between frames in samples
+	MinFrequency    float64 // lowest detectable pitch in Hz
+	MaxFrequency    float64 // highest detectable pitch in Hz
+	Threshold       float64 // YIN absolute threshold on the normalized difference
+	SilenceRMS      float64 // frames quieter than this are unvoiced
+	MinNoteDuration float64 // shorter notes are dropped, in seconds
+}
+
+// DefaultPitchTrackerOptions are tuned for a single voice humming into a phone or laptop mic
+var DefaultPitchTrackerOptions = PitchTrackerOptions{
+	SampleRate:      16000,
+	FrameSize:       1024,
+	HopSize:         256,
+	MinFrequency:    65,
+	MaxFrequency:    1000,
+	Threshold:       0.2,
+	SilenceRMS:      0.02,
+	MinNoteDuration: 0.08,
+}
+
+// PitchFrame is the pitch estimate of one analysis frame. Frequency is 0 for unvoiced frames.
+type PitchFrame struct {
+	Time      float64
+	Frequency float64
+	RMS       float64
+}
+
+// TranscribeWavFile decodes a WAV file and transcribes it into note events
+func TranscribeWavFile(path string, opts PitchTrackerOptions) ([]NoteEvent, error) {
+	audio, err := LoadWavFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := normalizePeak(Resample(audio.Samples, audio.SampleRate, opts.SampleRate))
+	return SegmentNotes(TrackPitch(samples, opts), opts), nil
+}
+
+// normalizePeak scales the samples so the loudest one reaches full scale, which keeps the
+// silence gate meaningful for quiet recordings
+func normalizePeak(samples []float64) []float64 {
+	var peak float64
+	for _, sample := range samples {
+		peak = math.Max(peak, math.Abs(sample))
+	}
+	if peak == 0 {
+		return samples
+	}
+	normalized := make([]float64, len(samples))
+	for i, sample := range samples {
+		normalized[i] = sample / peak
+	}
+	return normalized
+}
+
+// ConvertWavNatively transcribes a WAV file in-process and writes the notes and a MIDI
+// rendering next to it, returning the same (midi path, json path) pair as the converter service
+func ConvertWavNatively(audioPath string) (string, string, error) {
+	notes, err := TranscribeWavFile(audioPath, DefaultPitchTrackerOptions)
+	if err != nil {
+		return "", "", err
+	}
+
+	ext := filepath.Ext(audioPath)
+	basePath := strings.TrimSuffix(audioPath, ext)
+	midiPath := basePath + "_native.mid"
+	jsonPath := fmt.Sprintf("%s_%s_data.json", basePath, strings.ReplaceAll(uuid.New().String(), "-", ""))
+
+	if err := WriteMidiFile(midiPath, notes); err != nil {
+		return "", "", fmt.Errorf("failed to write MIDI file: %w", err)
+	}
+	if err := SaveNotesToJSON(jsonPath, notes, true); err != nil {
+		return "", "", fmt.Errorf("failed to write notes: %w", err)
+	}
+	return midiPath, jsonPath, nil
+}
+
+// TrackPitch runs the YIN estimator over overlapping frames of mono samples
+func TrackPitch(samples []float64, opts PitchTrackerOptions) []PitchFrame {
+	minLag, maxLag := pitchLags(opts)
+
+	var frames []PitchFrame
+	diff := make([]float64, maxLag+1)
+	for start := 0; start+opts.FrameSize <= len(samples); start += opts.HopSize {
+		frames = append(frames, analyzePitchFrame(samples[start:start+opts.FrameSize], start, diff, minLag, maxLag, 1, opts))
+	}
+	return frames
+}
+
+// pitchLags returns the range of YIN lags covering the detectable frequencies
+func pitchLags(opts PitchTrackerOptions) (int, int) {
+	minLag := int(float64(opts.SampleRate) / opts.MaxFrequency)
+	maxLag := int(float64(opts.SampleRate) / opts.MinFrequency)
+	return minLag, min(maxLag, opts.FrameSize/2)
+}
+
+// analyzePitchFrame estimates the pitch of the frame starting at sample start. The loudness
+// of the frame is scaled by gain before the silence gate.
+func analyzePitchFrame(frame []float64, start int, diff []float64, minLag, maxLag int, gain float64, opts PitchTrackerOptions) PitchFrame {
+	pitchFrame := PitchFrame{
+		Time: float64(start+opts.FrameSize/2) / float64(opts.SampleRate),
+		RMS:  rms(frame) * gain,
+	}
+	if pitchFrame.RMS >= opts.SilenceRMS {
+		pitchFrame.Frequency = yinFrequency(frame, diff, minLag, maxLag, opts)
+	}
+	return pitchFrame
+}
+
+// yinFrequency estimates the fundamental frequency of one frame, or 0 when it is unvoiced
+func yinFrequency(frame, diff []float64, minLag, maxLag int, opts PitchTrackerOptions) float64 {
+	window := len(frame) - maxLag
+
+	// Difference function
+	for lag := 1; lag <= maxLag; lag++ {
+		var sum float64
+		for i := 0; i < window; i++ {
+			delta := frame[i] - frame[i+lag]
+			sum += delta * delta
+		}
+		diff[lag] = sum
+	}
+
+	// Cumulative mean normalized difference
+	diff[0] = 1
+	var running float64
+	for lag := 1; lag <= maxLag; lag++ {
+		running += diff[lag]
+		if running == 0 {
+			diff[lag] = 1
+		} else {
+			diff[lag] *= float64(lag) / running
+		}
+	}
+
+	// First dip below the threshold, followed down to its local minimum
+	lag := -1
+	for l := max(minLag, 2); l < maxLag; l++ {
+		if diff[l] < opts.Threshold {
+			for l+1 < maxLag && diff[l+1] < diff[l] {
+				l++
+			}
+			lag = l
+			break
+		}
+	}
+	if lag < 0 {
+		return 0
+	}
+
+	// Parabolic interpolation around the minimum
+	refined := float64(lag)
+	if lag > 0 && lag < maxLag {
+		a, b, c := diff[lag-1], diff[lag], diff[lag+1]
+		if denom := a - 2*b + c; denom != 0 {
+			refined += (a - c) / (2 * denom)
+		}
+	}
+	return float64(opts.SampleRate) / refined
+}
+
+// SegmentNotes groups consecutive voiced frames with a stable rounded MIDI pitch into notes
+func SegmentNotes(frames []PitchFrame, opts PitchTrackerOptions) []NoteEvent {
+	if len(frames) == 0 {
+		return []NoteEvent{}
+	}
+	frameDuration := float64(opts.HopSize) / float64(opts.SampleRate)
+
+	// Median-filter the pitch track to remove single-frame octave errors
+	pitches := make([]float64, len(frames))
+	for i, frame := range frames {
+		if frame.Frequency > 0 {
+			pitches[i] = 69 + 12*math.Log2(frame.Frequency/440)
+		}
+	}
+	pitches = medianFilterVoiced(pitches, 2)
+
+	notes := []NoteEvent{}
+	maxRMS := 0.0
+	for _, frame := range frames {
+		maxRMS = math.Max(maxRMS, frame.RMS)
+	}
+
+	start := -1
+	closeNote := func(end int) {
+		if start < 0 {
+			return
+		}
+		duration := float64(end-start) * frameDuration
+		if duration >= opts.MinNoteDuration {
+			var pitchSum, rmsSum float64
+			for i := start; i < end; i++ {
+				pitchSum += pitches[i]
+				rmsSum += frames[i].RMS
+			}
+			count := float64(end - start)
+			velocity := 1
+			if maxRMS > 0 {
+				velocity = max(1, min(127, int(math.Round(127*rmsSum/count/maxRMS))))
+			}
+			notes = append(notes, NoteEvent{
+				Pitch:    max(0, min(127, int(math.Round(pitchSum/count)))),
+				Onset:    frames[start].Time - frameDuration/2,
+				Duration: duration,
+				Velocity: velocity,
+			})
+		}
+		start = -1
+	}
+
+	for i := range frames {
+		switch {
+		case pitches[i] == 0:
+			closeNote(i)
+		case start < 0:
+			start = i
+		case math.Abs(pitches[i]-math.Round(pitches[start])) > 0.75:
+			closeNote(i)
+			start = i
+		}
+	}
+	closeNote(len(frames))
+
+	return notes
+}
+
+// medianFilterVoiced replaces every voiced value with the median of the voiced values around it
+func medianFilterVoiced(values []float64, radius int) []float64 {
+	filtered := make([]float64, len(values))
+	for i, value := range values {
+		if value == 0 {
+			continue
+		}
+		var neighbours []float64
+		for j := max(0, i-radius); j <= min(len(values)-1, i+radius); j++ {
+			if values[j] != 0 {
+				neighbours = append(neighbours, values[j])
+			}
+		}
+		filtered[i] = median(neighbours)
+	}
+	return filtered
+}
+
+func rms(samples []float64) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += sample * sample
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
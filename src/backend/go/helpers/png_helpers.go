@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/image/webp"
 )
@@ -43,6 +44,13 @@ func ConvertToPng(filePath string) (string, error) {
 		return "", err
 	}
 
+	// Turn photos upright while their EXIF orientation is still known, PNG drops it
+	if lower := strings.ToLower(ext); (lower == ".jpg" || lower == ".jpeg") && DefaultImagePreprocessing.ExifOrientation {
+		if data, err := os.ReadFile(filePath); err == nil {
+			img = orientImage(img, jpegOrientation(data))
+		}
+	}
+
 	// Prepare the output file path
 	newFilePath := filePath[0:len(filePath)-len(ext)] + ".png"
 	log.Println("Output file path:", newFilePath)
@@ -0,0 +1,144 @@
+// query_cleanup_helpers.go contains the cleanup and quality checks applied to transcribed humming queries
+package helpers
+
+import (
+	"fmt"
+	"math"
+)
+
+// QueryCleanupOptions controls how transcribed hummings are cleaned up and when they are rejected
+type QueryCleanupOptions struct {
+	MinNoteDuration float64 // shorter notes are dropped, in seconds
+	JitterGap       float64 // neighbouring notes closer than this, in seconds, may be one note
+	JitterDuration  float64 // a semitone wobble is merged when one of the notes is shorter than this
+	OctaveJump      int     // isolated jumps of at least this many semitones are checked for octave errors
+	MinNotes        int     // queries with fewer notes are rejected
+	MinPitchRange   int     // queries spanning fewer semitones are rejected as flat
+}
+
+// DefaultQueryCleanupOptions are tuned for the native pitch tracker and the converter service
+var DefaultQueryCleanupOptions = QueryCleanupOptions{
+	MinNoteDuration: 0.06,
+	JitterGap:       0.05,
+	JitterDuration:  0.15,
+	OctaveJump:      10,
+	MinNotes:        5,
+	MinPitchRange:   2,
+}
+
+// QueryCleanupReport counts what the cleanup changed
+type QueryCleanupReport struct {
+	Dropped       int `json:"dropped"`
+	Merged        int `json:"merged"`
+	OctavesFolded int `json:"octavesFolded"`
+}
+
+// QueryRejection explains why a query cannot be searched
+type QueryRejection struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]int `json:"details"`
+}
+
+func (r *QueryRejection) Error() string {
+	return r.Message
+}
+
+// CleanQuery drops ultra-short notes, merges jittery repeats, folds isolated octave errors
+// and checks that enough of a melody is left. Untimed notes are only checked. The error is
+// a *QueryRejection when the query is too short or too flat to search.
+func CleanQuery(notes []NoteEvent, opts QueryCleanupOptions) ([]NoteEvent, QueryCleanupReport, error) {
+	var report QueryCleanupReport
+	cleaned := append([]NoteEvent(nil), notes...)
+
+	if HasTiming(cleaned) {
+		cleaned, report.Dropped = dropShortNotes(cleaned, opts)
+		cleaned, report.Merged = mergeJitterNotes(cleaned, opts)
+	}
+	report.OctavesFolded = foldOctaveSpikes(cleaned, opts)
+
+	if len(cleaned) < opts.MinNotes {
+		return cleaned, report, &QueryRejection{
+			Code:    "too_short",
+			Message: fmt.Sprintf("only %d notes detected, please hum longer", len(cleaned)),
+			Details: map[string]int{"notes": len(cleaned), "minNotes": opts.MinNotes},
+		}
+	}
+
+	lowest, highest := cleaned[0].Pitch, cleaned[0].Pitch
+	for _, note := range cleaned {
+		lowest, highest = min(lowest, note.Pitch), max(highest, note.Pitch)
+	}
+	if highest-lowest < opts.MinPitchRange {
+		return cleaned, report, &QueryRejection{
+			Code:    "too_flat",
+			Message: fmt.Sprintf("the melody only spans %d semitones, please hum the tune rather than a single note", highest-lowest),
+			Details: map[string]int{"pitchRange": highest - lowest, "minPitchRange": opts.MinPitchRange},
+		}
+	}
+	return cleaned, report, nil
+}
+
+func dropShortNotes(notes []NoteEvent, opts QueryCleanupOptions) ([]NoteEvent, int) {
+	kept := notes[:0]
+	for _, note := range notes {
+		if note.Duration >= opts.MinNoteDuration {
+			kept = append(kept, note)
+		}
+	}
+	return kept, len(notes) - len(kept)
+}
+
+// mergeJitterNotes joins neighbouring notes separated by a tiny gap when they repeat the
+// same pitch, or wobble by a semitone around a short note. The longer note keeps its pitch.
+func mergeJitterNotes(notes []NoteEvent, opts QueryCleanupOptions) ([]NoteEvent, int) {
+	if len(notes) == 0 {
+		return notes, 0
+	}
+	merged := []NoteEvent{notes[0]}
+	for _, note := range notes[1:] {
+		last := &merged[len(merged)-1]
+		gap := note.Onset - (last.Onset + last.Duration)
+		interval := abs(note.Pitch - last.Pitch)
+		wobble := interval == 1 && math.Min(note.Duration, last.Duration) < opts.JitterDuration
+
+		if gap < opts.JitterGap && (interval == 0 || wobble) {
+			if note.Duration > last.Duration {
+				last.Pitch = note.Pitch
+			}
+			last.Duration = note.Onset + note.Duration - last.Onset
+			continue
+		}
+		merged = append(merged, note)
+	}
+	return merged, len(notes) - len(merged)
+}
+
+// foldOctaveSpikes moves notes that leap away by about an octave and straight back, the
+// typical pitch tracker octave error, into the register of their neighbours
+func foldOctaveSpikes(notes []NoteEvent, opts QueryCleanupOptions) int {
+	folded := 0
+	for i := 1; i < len(notes); i++ {
+		jump := notes[i].Pitch - notes[i-1].Pitch
+		if abs(jump) < opts.OctaveJump {
+			continue
+		}
+		// A real leap stays in the new register, an error returns on the next note or, at the
+		// end of the query, is a short blip
+		if i+1 < len(notes) {
+			back := notes[i+1].Pitch - notes[i].Pitch
+			if abs(back) < opts.OctaveJump || (back > 0) == (jump > 0) {
+				continue
+			}
+		} else if !(notes[i].Duration > 0 && notes[i].Duration < opts.JitterDuration) {
+			continue
+		}
+		octaves := int(math.Round(float64(jump) / 12))
+		if octaves == 0 || abs(jump-12*octaves) > 2 {
+			continue
+		}
+		notes[i].Pitch = max(0, min(127, notes[i].Pitch-12*octaves))
+		folded++
+	}
+	return folded
+}
@@ -0,0 +1,105 @@
+// rhythm_helpers.go contains the tempo invariant rhythm matcher used by query-by-tapping
+package helpers
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	minTapInterval    = 0.03 // taps closer than this, in seconds, are one tap bouncing
+	maxRhythmError    = 1.0  // per-interval error cap, in octaves of duration
+	minTempoRatio     = 0.25 // the tapped tempo may be at most 4 times slower or faster
+	maxTempoRatio     = 4
+	tempoRangePenalty = 0.5 // score factor for matches outside the tempo range
+)
+
+// TapIntervals sorts tap timestamps in seconds and returns the intervals between them,
+// dropping double taps
+func TapIntervals(taps []float64) []float64 {
+	sorted := append([]float64(nil), taps...)
+	sort.Float64s(sorted)
+
+	var intervals []float64
+	last := math.Inf(-1)
+	for _, tap := range sorted {
+		if tap-last < minTapInterval {
+			continue
+		}
+		if !math.IsInf(last, -1) {
+			intervals = append(intervals, tap-last)
+		}
+		last = tap
+	}
+	return intervals
+}
+
+// MatchRhythm slides the tapped intervals over the inter-onset intervals of the song. Every
+// window is tempo-normalized by the scale that best fits it in the log domain, and scored by
+// the mean remaining log2 duration error. The score is 1 minus that error, in [0, 1].
+func MatchRhythm(taps []float64, song []NoteEvent) MelodyMatch {
+	queryIntervals := TapIntervals(taps)
+	if len(queryIntervals) == 0 || !HasTiming(song) {
+		return MelodyMatch{}
+	}
+
+	// Onsets that start together are one event, keep the index of the first note of each
+	var onsets []int
+	for i, note := range song {
+		if len(onsets) == 0 || note.Onset-song[onsets[len(onsets)-1]].Onset >= minTapInterval {
+			onsets = append(onsets, i)
+		}
+	}
+	if len(onsets) < 2 {
+		return MelodyMatch{}
+	}
+	songIntervals := make([]float64, len(onsets)-1)
+	for i := range songIntervals {
+		songIntervals[i] = song[onsets[i+1]].Onset - song[onsets[i]].Onset
+	}
+
+	queryLog := make([]float64, len(queryIntervals))
+	for i, interval := range queryIntervals {
+		queryLog[i] = math.Log2(interval)
+	}
+	songLog := make([]float64, len(songIntervals))
+	for i, interval := range songIntervals {
+		songLog[i] = math.Log2(interval)
+	}
+
+	n := min(len(queryLog), len(songLog))
+	bestScore, bestStart, bestRatio := -1.0, 0, 1.0
+	for start := 0; start+n <= len(songLog); start++ {
+		// The least squares tempo scale in the log domain is the mean difference
+		var shift float64
+		for i := 0; i < n; i++ {
+			shift += songLog[start+i] - queryLog[i]
+		}
+		shift /= float64(n)
+
+		var errorSum float64
+		for i := 0; i < n; i++ {
+			errorSum += math.Min(math.Abs(queryLog[i]+shift-songLog[start+i]), maxRhythmError)
+		}
+		score := 1 - errorSum/float64(n)/maxRhythmError
+
+		ratio := math.Exp2(shift)
+		if ratio < minTempoRatio || ratio > maxTempoRatio {
+			score *= tempoRangePenalty
+		}
+		// Queries longer than the song only match their first intervals
+		score *= float64(n) / float64(len(queryLog))
+
+		if score > bestScore {
+			bestScore, bestStart, bestRatio = score, start, ratio
+		}
+	}
+
+	startNote := onsets[bestStart]
+	endNote := len(song)
+	if bestStart+n+1 < len(onsets) {
+		endNote = onsets[bestStart+n+1]
+	}
+	features := map[string]float64{"rhythm": bestScore, "tempoRatio": bestRatio}
+	return newMelodyMatch(bestScore, features, song, startNote, endNote, true)
+}
@@ -0,0 +1,127 @@
+// similarity_metric_helpers.go contains the registry of named vector similarity metrics used by melody and image matching
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SimilarityMetric compares two non-negative vectors of the same length. Similarity is 1 for
+// identical vectors and 0 for vectors that share nothing.
+type SimilarityMetric struct {
+	Name        string
+	OrderedBins bool // only meaningful when neighbouring bins are neighbouring values, as in pitch histograms
+	Similarity  func(a, b []float64) float64
+}
+
+// similarityMetrics is the registry of metrics selectable by name
+var similarityMetrics = map[string]SimilarityMetric{
+	"cosine":       {Name: "cosine", Similarity: cosineSimilarity},
+	"euclidean":    {Name: "euclidean", Similarity: euclideanSimilarity},
+	"l1":           {Name: "l1", Similarity: l1Similarity},
+	"chi2":         {Name: "chi2", Similarity: chiSquareSimilarity},
+	"intersection": {Name: "intersection", Similarity: intersectionSimilarity},
+	"emd":          {Name: "emd", OrderedBins: true, Similarity: emdSimilarity},
+}
+
+// LookupMetric returns the metric registered under name
+func LookupMetric(name string) (SimilarityMetric, error) {
+	metric, ok := similarityMetrics[name]
+	if !ok {
+		return SimilarityMetric{}, fmt.Errorf("unknown metric %q, expected one of %s", name, strings.Join(MetricNames(), ", "))
+	}
+	return metric, nil
+}
+
+// MetricNames lists the registered metrics in alphabetical order
+func MetricNames() []string {
+	names := make([]string, 0, len(similarityMetrics))
+	for name := range similarityMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// asDistribution scales a vector so its entries sum to 1, or returns nil for an empty vector
+func asDistribution(vec []float64) []float64 {
+	var total float64
+	for _, value := range vec {
+		total += value
+	}
+	if total == 0 {
+		return nil
+	}
+	distribution := make([]float64, len(vec))
+	for i, value := range vec {
+		distribution[i] = value / total
+	}
+	return distribution
+}
+
+// euclideanSimilarity maps the distance between the two distributions, at most sqrt(2), to [0, 1]
+func euclideanSimilarity(vec1, vec2 []float64) float64 {
+	p, q := asDistribution(vec1), asDistribution(vec2)
+	if p == nil || q == nil {
+		return 0
+	}
+	return math.Max(0, 1-euclideanDistance(p, q)/math.Sqrt2)
+}
+
+// l1Similarity is 1 minus the total variation distance between the two distributions
+func l1Similarity(vec1, vec2 []float64) float64 {
+	p, q := asDistribution(vec1), asDistribution(vec2)
+	if p == nil || q == nil {
+		return 0
+	}
+	var distance float64
+	for i := range p {
+		distance += math.Abs(p[i] - q[i])
+	}
+	return math.Max(0, 1-distance/2)
+}
+
+// chiSquareSimilarity is 1 minus the symmetric chi-square distance between the two distributions
+func chiSquareSimilarity(vec1, vec2 []float64) float64 {
+	p, q := asDistribution(vec1), asDistribution(vec2)
+	if p == nil || q == nil {
+		return 0
+	}
+	var distance float64
+	for i := range p {
+		if sum := p[i] + q[i]; sum > 0 {
+			distance += (p[i] - q[i]) * (p[i] - q[i]) / sum
+		}
+	}
+	return math.Max(0, 1-distance/2)
+}
+
+// intersectionSimilarity is the overlap of the two distributions
+func intersectionSimilarity(vec1, vec2 []float64) float64 {
+	p, q := asDistribution(vec1), asDistribution(vec2)
+	if p == nil || q == nil {
+		return 0
+	}
+	var overlap float64
+	for i := range p {
+		overlap += math.Min(p[i], q[i])
+	}
+	return overlap
+}
+
+// emdSimilarity maps the earth mover's distance between the two distributions, measured in
+// bins, to 1 / (1 + distance). In one dimension it is the L1 distance of the cumulative sums.
+func emdSimilarity(vec1, vec2 []float64) float64 {
+	p, q := asDistribution(vec1), asDistribution(vec2)
+	if p == nil || q == nil {
+		return 0
+	}
+	var distance, carried float64
+	for i := range p {
+		carried += p[i] - q[i]
+		distance += math.Abs(carried)
+	}
+	return 1 / (1 + distance)
+}
@@ -0,0 +1,491 @@
+// smf_helpers.go contains a Standard MIDI File reader used to extract notes from .mid uploads
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MIDI meta event types used by the parser
+const (
+	metaTrackName     = 0x03
+	metaEndOfTrack    = 0x2F
+	metaSetTempo      = 0x51
+	metaTimeSignature = 0x58
+
+	defaultMicrosPerQuarter = 500000 // 120 BPM
+
+	maxChunkSize = 16 << 20 // larger chunks are rejected rather than read into memory
+)
+
+// MidiFile is a parsed Standard MIDI File (format 0 or 1)
+type MidiFile struct {
+	Format         int
+	Division       int // ticks per quarter note, or ticks per frame for SMPTE timing
+	FramesPerSec   int // non-zero when the file uses SMPTE timing
+	Tracks         []MidiTrack
+	Tempos         []TempoChange
+	TimeSignatures []TimeSignature
+}
+
+// MidiTrack holds the events of a single MTrk chunk with absolute tick times
+type MidiTrack struct {
+	Name   string
+	Events []MidiEvent
+}
+
+// MidiEvent is a channel, meta or sysex event. Status is 0xFF for meta events,
+// 0xF0/0xF7 for sysex, and the status nibble (0x80..0xE0) for channel events.
+type MidiEvent struct {
+	Tick     uint64
+	Status   byte
+	Channel  int
+	Data1    byte
+	Data2    byte
+	MetaType byte
+	Data     []byte
+}
+
+// TempoChange marks the tick at which a new tempo takes effect
+type TempoChange struct {
+	Tick             uint64
+	MicrosPerQuarter int
+}
+
+// TimeSignature marks the tick at which a new time signature takes effect
+type TimeSignature struct {
+	Tick        uint64
+	Numerator   int
+	Denominator int
+}
+
+// NoteEvent is a single sounding note with timing in seconds
+type NoteEvent struct {
+	Pitch    int     `json:"pitch"`
+	Onset    float64 `json:"onset"`
+	Duration float64 `json:"duration"`
+	Velocity int     `json:"velocity"`
+	Channel  int     `json:"channel"`
+	Track    int     `json:"track"`
+}
+
+// IsMidiFile reports whether the path has a Standard MIDI File extension
+func IsMidiFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".mid" || ext == ".midi"
+}
+
+// ParseMidiFile reads and parses a Standard MIDI File from disk
+func ParseMidiFile(path string) (*MidiFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	midi, err := ParseMidi(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MIDI file %s: %w", path, err)
+	}
+	return midi, nil
+}
+
+// ParseMidi parses a Standard MIDI File from a reader
+func ParseMidi(r io.Reader) (*MidiFile, error) {
+	chunkType, header, err := readChunk(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header chunk: %w", err)
+	}
+	if chunkType != "MThd" || len(header) < 6 {
+		return nil, errors.New("missing MThd header")
+	}
+
+	midi := &MidiFile{Format: int(binary.BigEndian.Uint16(header[0:2]))}
+	if midi.Format != 0 && midi.Format != 1 {
+		return nil, fmt.Errorf("unsupported MIDI format %d", midi.Format)
+	}
+	trackCount := int(binary.BigEndian.Uint16(header[2:4]))
+
+	// Negative division (high bit set) means SMPTE frames per second and ticks per frame
+	division := binary.BigEndian.Uint16(header[4:6])
+	if division&0x8000 != 0 {
+		midi.FramesPerSec = int(-int8(division >> 8))
+		midi.Division = int(division & 0xFF)
+	} else {
+		midi.Division = int(division)
+	}
+	if midi.Division == 0 {
+		return nil, errors.New("invalid time division")
+	}
+
+	for len(midi.Tracks) < trackCount {
+		chunkType, data, err := readChunk(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read track %d: %w", len(midi.Tracks), err)
+		}
+		// Unknown chunk types must be skipped according to the spec
+		if chunkType != "MTrk" {
+			continue
+		}
+
+		track, err := parseTrack(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse track %d: %w", len(midi.Tracks), err)
+		}
+		midi.Tracks = append(midi.Tracks, track)
+	}
+
+	midi.collectTempoMap()
+	return midi, nil
+}
+
+func readChunk(r io.Reader) (string, []byte, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", nil, err
+	}
+	length := binary.BigEndian.Uint32(head[4:8])
+	if length > maxChunkSize {
+		return "", nil, fmt.Errorf("chunk %q of %d bytes exceeds the %d byte limit", head[0:4], length, maxChunkSize)
+	}
+	// Read no more than the input holds instead of trusting the declared length up front
+	data, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data) < int(length) {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(head[0:4]), data, nil
+}
+
+func readVarLen(data []byte, pos int) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < 4; i++ {
+		if pos >= len(data) {
+			return 0, pos, io.ErrUnexpectedEOF
+		}
+		b := data[pos]
+		pos++
+		value = value<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			return value, pos, nil
+		}
+	}
+	return 0, pos, errors.New("variable-length quantity too long")
+}
+
+func parseTrack(data []byte) (MidiTrack, error) {
+	var track MidiTrack
+	var tick uint64
+	var runningStatus byte
+	pos := 0
+
+	for pos < len(data) {
+		delta, next, err := readVarLen(data, pos)
+		if err != nil {
+			return track, err
+		}
+		pos = next
+		tick += delta
+
+		if pos >= len(data) {
+			return track, io.ErrUnexpectedEOF
+		}
+		status := data[pos]
+
+		switch {
+		case status == 0xFF:
+			// Meta event: type, length, data
+			if pos+2 > len(data) {
+				return track, io.ErrUnexpectedEOF
+			}
+			metaType := data[pos+1]
+			length, next, err := readVarLen(data, pos+2)
+			if err != nil {
+				return track, err
+			}
+			end := next + int(length)
+			if end > len(data) {
+				return track, io.ErrUnexpectedEOF
+			}
+			event := MidiEvent{Tick: tick, Status: status, MetaType: metaType, Data: data[next:end]}
+			track.Events = append(track.Events, event)
+			if metaType == metaTrackName && track.Name == "" {
+				track.Name = string(event.Data)
+			}
+			pos = end
+			runningStatus = 0
+			if metaType == metaEndOfTrack {
+				return track, nil
+			}
+
+		case status == 0xF0 || status == 0xF7:
+			// Sysex event: length, data
+			length, next, err := readVarLen(data, pos+1)
+			if err != nil {
+				return track, err
+			}
+			end := next + int(length)
+			if end > len(data) {
+				return track, io.ErrUnexpectedEOF
+			}
+			track.Events = append(track.Events, MidiEvent{Tick: tick, Status: status, Data: data[next:end]})
+			pos = end
+			runningStatus = 0
+
+		default:
+			// Channel event, possibly using running status
+			if status&0x80 != 0 {
+				runningStatus = status
+				pos++
+			} else if runningStatus == 0 {
+				return track, fmt.Errorf("data byte 0x%02X without running status", status)
+			}
+
+			kind := runningStatus & 0xF0
+			size := 2
+			if kind == 0xC0 || kind == 0xD0 {
+				size = 1
+			}
+			if pos+size > len(data) {
+				return track, io.ErrUnexpectedEOF
+			}
+
+			event := MidiEvent{
+				Tick:    tick,
+				Status:  kind,
+				Channel: int(runningStatus & 0x0F),
+				Data1:   data[pos],
+			}
+			if size == 2 {
+				event.Data2 = data[pos+1]
+			}
+			track.Events = append(track.Events, event)
+			pos += size
+		}
+	}
+
+	return track, nil
+}
+
+// collectTempoMap gathers tempo and time signature meta events from all tracks, ordered by tick
+func (m *MidiFile) collectTempoMap() {
+	m.Tempos = nil
+	m.TimeSignatures = nil
+	for _, track := range m.Tracks {
+		for _, event := range track.Events {
+			if event.Status != 0xFF {
+				continue
+			}
+			switch {
+			case event.MetaType == metaSetTempo && len(event.Data) == 3:
+				micros := int(event.Data[0])<<16 | int(event.Data[1])<<8 | int(event.Data[2])
+				m.Tempos = append(m.Tempos, TempoChange{Tick: event.Tick, MicrosPerQuarter: micros})
+			case event.MetaType == metaTimeSignature && len(event.Data) >= 2:
+				m.TimeSignatures = append(m.TimeSignatures, TimeSignature{
+					Tick:        event.Tick,
+					Numerator:   int(event.Data[0]),
+					Denominator: 1 << event.Data[1],
+				})
+			}
+		}
+	}
+	sort.SliceStable(m.Tempos, func(i, j int) bool { return m.Tempos[i].Tick < m.Tempos[j].Tick })
+	sort.SliceStable(m.TimeSignatures, func(i, j int) bool { return m.TimeSignatures[i].Tick < m.TimeSignatures[j].Tick })
+}
+
+// TickToSeconds converts an absolute tick to seconds using the tempo map
+func (m *MidiFile) TickToSeconds(tick uint64) float64 {
+	if m.FramesPerSec > 0 {
+		return float64(tick) / float64(m.FramesPerSec*m.Division)
+	}
+
+	seconds := 0.0
+	lastTick := uint64(0)
+	micros := defaultMicrosPerQuarter
+	for _, tempo := range m.Tempos {
+		if tempo.Tick >= tick {
+			break
+		}
+		seconds += float64(tempo.Tick-lastTick) * float64(micros) / 1e6 / float64(m.Division)
+		lastTick = tempo.Tick
+		micros = tempo.MicrosPerQuarter
+	}
+	seconds += float64(tick-lastTick) * float64(micros) / 1e6 / float64(m.Division)
+	return seconds
+}
+
+// NotesArray returns the pitch of every note-on in track order, matching the converter output
+func (m *MidiFile) NotesArray() []int {
+	notes := []int{}
+	for _, track := range m.Tracks {
+		for _, event := range track.Events {
+			if event.Status == 0x90 && event.Data2 > 0 {
+				notes = append(notes, int(event.Data1))
+			}
+		}
+	}
+	return notes
+}
+
+// NoteEvents pairs note-on and note-off events into notes sorted by onset
+func (m *MidiFile) NoteEvents() []NoteEvent {
+	type noteKey struct {
+		channel int
+		pitch   byte
+	}
+	type pendingNote struct {
+		tick     uint64
+		velocity byte
+	}
+
+	var notes []NoteEvent
+	for trackIndex, track := range m.Tracks {
+		pending := map[noteKey][]pendingNote{}
+
+		closeNote := func(key noteKey, tick uint64) {
+			queue := pending[key]
+			if len(queue) == 0 {
+				return
+			}
+			start := queue[0]
+			pending[key] = queue[1:]
+
+			onset := m.TickToSeconds(start.tick)
+			notes = append(notes, NoteEvent{
+				Pitch:    int(key.pitch),
+				Onset:    onset,
+				Duration: m.TickToSeconds(tick) - onset,
+				Velocity: int(start.velocity),
+				Channel:  key.channel,
+				Track:    trackIndex,
+			})
+		}
+
+		var lastTick uint64
+		for _, event := range track.Events {
+			lastTick = event.Tick
+			key := noteKey{channel: event.Channel, pitch: event.Data1}
+			switch {
+			case event.Status == 0x90 && event.Data2 > 0:
+				pending[key] = append(pending[key], pendingNote{tick: event.Tick, velocity: event.Data2})
+			case event.Status == 0x80 || (event.Status == 0x90 && event.Data2 == 0):
+				closeNote(key, event.Tick)
+			}
+		}
+
+		// Notes still sounding at the end of the track end with the track
+		for key, queue := range pending {
+			for range queue {
+				closeNote(key, lastTick)
+			}
+		}
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].Onset != notes[j].Onset {
+			return notes[i].Onset < notes[j].Onset
+		}
+		return notes[i].Pitch > notes[j].Pitch
+	})
+	return notes
+}
+
+// ConvertMidiNatively parses a .mid file in-process and writes its note events next to it,
+// returning the same (midi path, json path) pair as the converter service
+func ConvertMidiNatively(midiPath string) (string, string, error) {
+	midi, err := ParseMidiFile(midiPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	ext := filepath.Ext(midiPath)
+	baseName := strings.TrimSuffix(filepath.Base(midiPath), ext)
+	jsonPath := filepath.Join(filepath.Dir(midiPath), fmt.Sprintf("%s_%s_data.json", baseName, strings.ReplaceAll(uuid.New().String(), "-", "")))
+
+	if err := SaveNotesToJSON(jsonPath, midi.NoteEvents(), true); err != nil {
+		return "", "", fmt.Errorf("failed to write notes: %w", err)
+	}
+
+	return midiPath, jsonPath, nil
+}
+
+// WriteMidiFile renders note events as a format 0 file at 120 BPM
+func WriteMidiFile(path string, notes []NoteEvent) error {
+	const division = 480
+	ticksPerSecond := float64(division) * 1e6 / defaultMicrosPerQuarter
+
+	type timedEvent struct {
+		tick   uint64
+		status byte
+		pitch  byte
+		value  byte
+	}
+	var events []timedEvent
+	for _, note := range notes {
+		channel := byte(note.Channel & 0x0F)
+		start := uint64(math.Round(note.Onset * ticksPerSecond))
+		// Notes shorter than a tick still last one, or their note-off would sort before the note-on
+		end := max(start+1, uint64(math.Round((note.Onset+note.Duration)*ticksPerSecond)))
+		events = append(events,
+			timedEvent{tick: start, status: 0x90 | channel, pitch: byte(note.Pitch), value: byte(note.Velocity)},
+			timedEvent{tick: end, status: 0x80 | channel, pitch: byte(note.Pitch)},
+		)
+	}
+	// Note-offs go before note-ons on the same tick so repeated pitches are not cut short
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].tick != events[j].tick {
+			return events[i].tick < events[j].tick
+		}
+		return events[i].status&0xF0 < events[j].status&0xF0
+	})
+
+	var track bytes.Buffer
+	track.Write([]byte{0x00, 0xFF, metaSetTempo, 0x03, 0x07, 0xA1, 0x20})
+	lastTick := uint64(0)
+	for _, event := range events {
+		writeVarLen(&track, event.tick-lastTick)
+		track.Write([]byte{event.status, event.pitch, event.value})
+		lastTick = event.tick
+	}
+	track.Write([]byte{0x00, 0xFF, metaEndOfTrack, 0x00})
+
+	var file bytes.Buffer
+	file.WriteString("MThd")
+	binary.Write(&file, binary.BigEndian, uint32(6))
+	binary.Write(&file, binary.BigEndian, []uint16{0, 1, division})
+	file.WriteString("MTrk")
+	binary.Write(&file, binary.BigEndian, uint32(track.Len()))
+	file.Write(track.Bytes())
+
+	return os.WriteFile(path, file.Bytes(), 0644)
+}
+
+func writeVarLen(buf *bytes.Buffer, value uint64) {
+	var stack [10]byte
+	n := 0
+	stack[n] = byte(value & 0x7F)
+	n++
+	for value >>= 7; value > 0; value >>= 7 {
+		stack[n] = byte(value&0x7F) | 0x80
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(stack[i])
+	}
+}
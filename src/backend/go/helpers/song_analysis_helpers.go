@@ -0,0 +1,157 @@
+// song_analysis_helpers.go contains the key, tempo and range analysis stored on every song
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Krumhansl-Kessler key profiles, starting at the tonic
+var (
+	majorKeyProfile = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorKeyProfile = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// Tonic spellings used in key names, by pitch class
+var (
+	majorTonics = [12]string{"C", "Db", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+	minorTonics = [12]string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "G#", "A", "Bb", "B"}
+)
+
+// SongAnalysis describes a song's notes. Tempo and TimeSignature are nil when the MIDI file
+// has no such meta events or is unavailable.
+type SongAnalysis struct {
+	Key           string
+	KeyConfidence float64 // correlation of the pitch class histogram with the key profile
+	Tempo         *float64
+	TimeSignature *string
+	Duration      float64 // seconds, 0 when the notes carry no timing
+	NoteCount     int
+	PitchMin      int
+	PitchMax      int
+}
+
+// AnalyzeSong analyzes the pitched notes of a song, reading tempo and time signature from
+// its parsed MIDI file when midi is not nil
+func AnalyzeSong(notes []NoteEvent, midi *MidiFile) SongAnalysis {
+	var analysis SongAnalysis
+	var pitched []NoteEvent
+	for _, note := range notes {
+		if note.Channel != percussionChannel {
+			pitched = append(pitched, note)
+		}
+	}
+
+	analysis.NoteCount = len(pitched)
+	analysis.Key, analysis.KeyConfidence = EstimateKey(pitched)
+	for i, note := range pitched {
+		if i == 0 || note.Pitch < analysis.PitchMin {
+			analysis.PitchMin = note.Pitch
+		}
+		if i == 0 || note.Pitch > analysis.PitchMax {
+			analysis.PitchMax = note.Pitch
+		}
+		analysis.Duration = math.Max(analysis.Duration, note.Onset+note.Duration)
+	}
+
+	if midi != nil {
+		if len(midi.Tempos) > 0 && midi.Tempos[0].MicrosPerQuarter > 0 {
+			tempo := math.Round(60e6/float64(midi.Tempos[0].MicrosPerQuarter)*100) / 100
+			analysis.Tempo = &tempo
+		}
+		if len(midi.TimeSignatures) > 0 {
+			signature := fmt.Sprintf("%d/%d", midi.TimeSignatures[0].Numerator, midi.TimeSignatures[0].Denominator)
+			analysis.TimeSignature = &signature
+		}
+	}
+	return analysis
+}
+
+// EstimateKey correlates the duration-weighted pitch class histogram with the 24 rotated
+// Krumhansl-Kessler profiles and returns the best key, e.g. "A minor", with its correlation
+func EstimateKey(notes []NoteEvent) (string, float64) {
+	if len(notes) == 0 {
+		return "", 0
+	}
+	timed := HasTiming(notes)
+
+	var histogram [12]float64
+	for _, note := range notes {
+		weight := 1.0
+		if timed {
+			weight = note.Duration
+		}
+		histogram[note.Pitch%12] += weight
+	}
+
+	bestKey, bestCorrelation := "", math.Inf(-1)
+	for tonic := 0; tonic < 12; tonic++ {
+		var major, minor [12]float64
+		for i := 0; i < 12; i++ {
+			major[(tonic+i)%12] = majorKeyProfile[i]
+			minor[(tonic+i)%12] = minorKeyProfile[i]
+		}
+		if correlation := pearson(histogram[:], major[:]); correlation > bestCorrelation {
+			bestKey, bestCorrelation = majorTonics[tonic]+" major", correlation
+		}
+		if correlation := pearson(histogram[:], minor[:]); correlation > bestCorrelation {
+			bestKey, bestCorrelation = minorTonics[tonic]+" minor", correlation
+		}
+	}
+	return bestKey, bestCorrelation
+}
+
+// NormalizeKeyName turns key names such as "Am", "a min", "Bb major" or "A#" into the
+// spelling used by EstimateKey, e.g. "A minor"
+func NormalizeKeyName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("empty key")
+	}
+
+	letter, ok := abcLetters[rune(strings.ToUpper(name[:1])[0])]
+	if !ok {
+		return "", fmt.Errorf("invalid key %q", name)
+	}
+	pitchClass := letter.semitone
+	rest := name[1:]
+	if strings.HasPrefix(rest, "#") {
+		pitchClass++
+		rest = rest[1:]
+	} else if strings.HasPrefix(rest, "b") {
+		pitchClass--
+		rest = rest[1:]
+	}
+	pitchClass = (pitchClass + 12) % 12
+
+	switch strings.ToLower(strings.TrimSpace(rest)) {
+	case "", "maj", "major":
+		return majorTonics[pitchClass] + " major", nil
+	case "m", "min", "minor":
+		return minorTonics[pitchClass] + " minor", nil
+	default:
+		return "", fmt.Errorf("invalid key %q, expected e.g. C major or A minor", name)
+	}
+}
+
+func pearson(a, b []float64) float64 {
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= float64(len(a))
+	meanB /= float64(len(b))
+
+	var cov, varA, varB float64
+	for i := range a {
+		cov += (a[i] - meanA) * (b[i] - meanB)
+		varA += (a[i] - meanA) * (a[i] - meanA)
+		varB += (b[i] - meanB) * (b[i] - meanB)
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
@@ -0,0 +1,32 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Storage persists files generated by the backend, such as converted MIDI and notes files
+type Storage interface {
+	// Save writes data under relativePath and returns the path the rest of the app uses to read it
+	Save(relativePath string, data []byte) (string, error)
+}
+
+// LocalStorage stores files on the local disk below BaseDir
+type LocalStorage struct {
+	BaseDir string
+}
+
+// Save writes data to BaseDir/relativePath, creating missing folders
+func (s LocalStorage) Save(relativePath string, data []byte) (string, error) {
+	fullPath := filepath.FromSlash(filepath.Join(s.BaseDir, relativePath))
+
+	// Ensure the folder exists
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
@@ -0,0 +1,272 @@
+// wav_helpers.go contains a WAV decoder producing mono float samples for the native pitch tracker
+package helpers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WAV format tags
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// WAV chunk size limits, checked before anything is allocated
+const (
+	maxWavFormatSize = 1 << 10
+	maxWavDataSize   = 256 << 20 // about 23 minutes of 48 kHz 24-bit stereo
+)
+
+// Sample rates accepted from WAV files and audio streams
+const (
+	MinSampleRate = 8000
+	MaxSampleRate = 192000
+)
+
+// Decoded audio limits, which also bound what resampling allocates
+const (
+	maxWavSeconds = 15 * 60
+	maxWavFrames  = 1 << 25 // 256 MB of mono float64 samples
+)
+
+// WavAudio is a decoded WAV file downmixed to mono, with samples in [-1, 1]
+type WavAudio struct {
+	SampleRate int
+	Channels   int // channel count of the source file
+	Samples    []float64
+}
+
+// Duration returns the length of the audio in seconds
+func (a *WavAudio) Duration() float64 {
+	return float64(len(a.Samples)) / float64(a.SampleRate)
+}
+
+// IsWavFile reports whether the path has a WAV extension
+func IsWavFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".wav" || ext == ".wave"
+}
+
+// LoadWavFile decodes a WAV file from disk
+func LoadWavFile(path string) (*WavAudio, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	audio, err := DecodeWav(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode WAV file %s: %w", path, err)
+	}
+	return audio, nil
+}
+
+// DecodeWav decodes 8/16/24/32-bit PCM and 32/64-bit float WAV data and downmixes it to mono
+func DecodeWav(r io.Reader) (*WavAudio, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a RIFF/WAVE file")
+	}
+
+	var format, channels, bitsPerSample int
+	var sampleRate int
+	haveFormat := false
+
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("missing data chunk")
+			}
+			return nil, err
+		}
+		chunkID := string(head[0:4])
+		size := int64(binary.LittleEndian.Uint32(head[4:8]))
+
+		switch chunkID {
+		case "fmt ":
+			if size > maxWavFormatSize {
+				return nil, fmt.Errorf("fmt chunk of %d bytes is too large", size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			if len(data) < 16 {
+				return nil, errors.New("fmt chunk too short")
+			}
+			format = int(binary.LittleEndian.Uint16(data[0:2]))
+			channels = int(binary.LittleEndian.Uint16(data[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(data[4:8]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(data[14:16]))
+			// The real format of WAVE_FORMAT_EXTENSIBLE is the first two bytes of the sub-format GUID
+			if format == wavFormatExtensible && len(data) >= 26 {
+				format = int(binary.LittleEndian.Uint16(data[24:26]))
+			}
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return nil, errors.New("data chunk before fmt chunk")
+			}
+			if channels == 0 {
+				return nil, errors.New("invalid channel count")
+			}
+			if sampleRate < MinSampleRate || sampleRate > MaxSampleRate {
+				return nil, fmt.Errorf("sample rate must be between %d and %d, got %d", MinSampleRate, MaxSampleRate, sampleRate)
+			}
+			// Read what is actually there rather than allocating the declared size, which
+			// streaming recorders often leave at its maximum. Truncated recordings are common,
+			// keep whatever was written.
+			limit := size
+			if limit > maxWavDataSize {
+				limit = maxWavDataSize + 1
+			}
+			data, err := io.ReadAll(io.LimitReader(r, limit))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > maxWavDataSize {
+				return nil, fmt.Errorf("data chunk exceeds the %d byte limit", maxWavDataSize)
+			}
+			if frameSize := bitsPerSample / 8 * channels; frameSize > 0 {
+				frames := len(data) / frameSize
+				if frames > maxWavFrames || frames > maxWavSeconds*sampleRate {
+					return nil, fmt.Errorf("audio longer than %d minutes is not supported", maxWavSeconds/60)
+				}
+			}
+			samples, err := decodeSamples(data, format, bitsPerSample, channels)
+			if err != nil {
+				return nil, err
+			}
+			return &WavAudio{SampleRate: sampleRate, Channels: channels, Samples: samples}, nil
+
+		default:
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return nil, err
+			}
+		}
+
+		// Chunks are padded to an even size
+		if size%2 == 1 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil && err != io.EOF {
+				return nil, err
+			}
+		}
+	}
+}
+
+// DecodeStreamChunk decodes raw mono samples streamed by a client, either "pcm16" signed
+// 16-bit or "float32" samples, both little-endian
+func DecodeStreamChunk(data []byte, format string) ([]float64, error) {
+	switch format {
+	case "pcm16":
+		if len(data)%2 != 0 {
+			return nil, errors.New("pcm16 chunks must hold whole 2-byte samples")
+		}
+		return decodeSamples(data, wavFormatPCM, 16, 1)
+	case "float32":
+		if len(data)%4 != 0 {
+			return nil, errors.New("float32 chunks must hold whole 4-byte samples")
+		}
+		return decodeSamples(data, wavFormatFloat, 32, 1)
+	default:
+		return nil, fmt.Errorf("unknown sample format %q, expected pcm16 or float32", format)
+	}
+}
+
+func decodeSamples(data []byte, format, bitsPerSample, channels int) ([]float64, error) {
+	bytesPerSample := bitsPerSample / 8
+	var read func([]byte) float64
+
+	switch {
+	case format == wavFormatPCM && bitsPerSample == 8:
+		read = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == wavFormatPCM && bitsPerSample == 16:
+		read = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	case format == wavFormatPCM && bitsPerSample == 24:
+		read = func(b []byte) float64 {
+			value := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float64(value) / 8388608
+		}
+	case format == wavFormatPCM && bitsPerSample == 32:
+		read = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648 }
+	case format == wavFormatFloat && bitsPerSample == 32:
+		read = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case format == wavFormatFloat && bitsPerSample == 64:
+		read = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", format, bitsPerSample)
+	}
+
+	frameSize := bytesPerSample * channels
+	frames := len(data) / frameSize
+	samples := make([]float64, frames)
+	for i := 0; i < frames; i++ {
+		var sum float64
+		for ch := 0; ch < channels; ch++ {
+			offset := i*frameSize + ch*bytesPerSample
+			sum += read(data[offset : offset+bytesPerSample])
+		}
+		samples[i] = sum / float64(channels)
+	}
+	return samples, nil
+}
+
+// Resample converts mono samples to another sample rate with linear interpolation.
+// When downsampling, a moving-average filter is applied first to limit aliasing.
+func Resample(samples []float64, fromRate, toRate int) []float64 {
+	if fromRate == toRate || len(samples) == 0 {
+		return samples
+	}
+
+	source := samples
+	if toRate < fromRate {
+		width := int(math.Ceil(float64(fromRate) / float64(toRate)))
+		source = movingAverage(samples, width)
+	}
+
+	ratio := float64(fromRate) / float64(toRate)
+	length := int(float64(len(source)) / ratio)
+	resampled := make([]float64, length)
+	for i := range resampled {
+		position := float64(i) * ratio
+		index := int(position)
+		frac := position - float64(index)
+		if index+1 < len(source) {
+			resampled[i] = source[index]*(1-frac) + source[index+1]*frac
+		} else {
+			resampled[i] = source[len(source)-1]
+		}
+	}
+	return resampled
+}
+
+func movingAverage(samples []float64, width int) []float64 {
+	if width <= 1 {
+		return samples
+	}
+	filtered := make([]float64, len(samples))
+	var sum float64
+	for i, sample := range samples {
+		sum += sample
+		if i >= width {
+			sum -= samples[i-width]
+		}
+		filtered[i] = sum / float64(min(i+1, width))
+	}
+	return filtered
+}
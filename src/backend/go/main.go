@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bos/pablo/controllers"
+	"bos/pablo/helpers"
 	"bos/pablo/models"
 	"bos/pablo/routes"
+	"bos/pablo/services"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -33,12 +39,59 @@ func main() {
 	// Auto migrate schema
 	models.AutoMigrateAll(db)
 
+	// Image preprocessing options, which the stored album vectors must match
+	if err := helpers.LoadImagePreprocessingFromEnv(); err != nil {
+		log.Fatalf("Invalid IMAGE_* preprocessing configuration: %v", err)
+	}
+
+	// Server-side defaults of the melody tuning parameters
+	if err := helpers.LoadMelodyParamsFromEnv(); err != nil {
+		log.Fatalf("Invalid MELODY_* configuration: %v", err)
+	}
+
+	// Server-side defaults of the image search weights
+	if err := helpers.LoadImageWeightsFromEnv(); err != nil {
+		log.Fatalf("Invalid IMAGE_WEIGHT_* configuration: %v", err)
+	}
+
+	// Subcommands run against the database and exit instead of starting the server, so they
+	// skip the stored data upgrades below
+	if len(os.Args) > 1 {
+		runCommand(db, os.Args[1], os.Args[2:])
+		return
+	}
+
+	// Upgrade legacy notes files to the versioned note-event format
+	if err := services.MigrateNotesJSON(db); err != nil {
+		log.Println("Failed to migrate notes files:", err)
+	}
+
+	// Analyze songs stored before key, tempo and range analysis existed
+	if err := services.AnalyzeMissingSongs(db); err != nil {
+		log.Println("Failed to analyze songs:", err)
+	}
+
+	// Preprocess album covers flattened with other options
+	if err := services.ReprocessStaleAlbums(db); err != nil {
+		log.Println("Failed to preprocess albums:", err)
+	}
+
+	// Hash album covers stored before perceptual hash search existed
+	if err := services.HashMissingAlbums(db); err != nil {
+		log.Println("Failed to hash albums:", err)
+	}
+
+	// Extract the colors of album covers stored before color search existed
+	if err := services.ExtractMissingAlbumColors(db); err != nil {
+		log.Println("Failed to extract album colors:", err)
+	}
+
 	// Initialize gin router
 	router := gin.Default()
 
 	// Cors for development
 	corsConfig := cors.Config{
-		AllowOrigins:     []string{"http://localhost:4000"},
+		AllowOrigins:     controllers.AllowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		AllowCredentials: true,
@@ -47,12 +100,33 @@ func main() {
 	router.Use(cors.New(corsConfig))
 
 	// Setup Routes
-	routes.SetupRouter(router, db)
+	routes.SetupRouter(router, db, converterSet())
 
 	// Run server
 	router.Run(":4001")
 }
 
+// converterSet builds the MIDI converters from CONVERTER_URL, CONVERTER_TIMEOUT (seconds)
+// and CONVERTER_RETRIES
+func converterSet() helpers.ConverterSet {
+	baseURL := os.Getenv("CONVERTER_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:8000"
+	}
+	timeout, err := strconv.Atoi(os.Getenv("CONVERTER_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = 120
+	}
+	retries, err := strconv.Atoi(os.Getenv("CONVERTER_RETRIES"))
+	if err != nil || retries < 0 {
+		retries = 2
+	}
+
+	storage := helpers.LocalStorage{BaseDir: "public/uploads"}
+	remote := helpers.NewHTTPConverter(baseURL, storage, time.Duration(timeout)*time.Second, retries)
+	return helpers.NewConverterSet(remote)
+}
+
 func dsn() string {
 	dbname := os.Getenv("DATABASE_NAME")
 	username := os.Getenv("DATABASE_USERNAME")
@@ -60,3 +134,72 @@ func dsn() string {
 	hostname := os.Getenv("DATABASE_SERVER")
 	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=5432 sslmode=disable TimeZone=Asia/Shanghai", hostname, username, password, dbname)
 }
+
+// runCommand runs a maintenance subcommand, e.g. `go run . reindex --force` or `go run . fingerprint`
+func runCommand(db *gorm.DB, name string, args []string) {
+	switch name {
+	case "reindex":
+		flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+		force := flags.Bool("force", false, "rebuild the melody features of every song, not only outdated ones")
+		flags.Parse(args)
+
+		indexed, err := services.ReindexSongs(db, *force)
+		if err != nil {
+			log.Fatalf("Failed to reindex songs: %v", err)
+		}
+		log.Printf("Reindexed %d songs\n", indexed)
+	case "fingerprint":
+		flags := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+		force := flags.Bool("force", false, "rebuild the audio fingerprints of every WAV song, not only outdated ones")
+		flags.Parse(args)
+
+		fingerprinted, err := services.FingerprintSongs(db, *force)
+		if err != nil {
+			log.Fatalf("Failed to fingerprint songs: %v", err)
+		}
+		log.Printf("Fingerprinted %d songs\n", fingerprinted)
+	case "evaluate":
+		flags := flag.NewFlagSet("evaluate", flag.ExitOnError)
+		queries := flags.String("queries", "", "directory of query files")
+		truth := flags.String("truth", "", "JSON ground truth mapping query files to songs or albums (default: <queries>/truth.json)")
+		out := flags.String("out", "", "report path without extension (default: evaluation-<timestamp>)")
+		matcher := flags.String("matcher", "histogram", "melody matcher for audio queries")
+		transcriber := flags.String("transcriber", "", "humming transcriber for audio queries, native or python")
+		metric := flags.String("metric", helpers.PictureMetricPCA, "picture metric for image queries")
+		flags.Parse(args)
+
+		if *queries == "" {
+			log.Fatalf("Usage: go run . evaluate --queries <dir> [--truth <file>] [--out <path>]")
+		}
+		if *truth == "" {
+			*truth = filepath.Join(*queries, "truth.json")
+		}
+		if *out == "" {
+			*out = "evaluation-" + time.Now().Format("20060102-150405")
+		}
+
+		report, err := services.RunEvaluation(db, converterSet(), services.EvaluationConfig{
+			QueryDir:     *queries,
+			TruthPath:    *truth,
+			Matcher:      *matcher,
+			Transcriber:  *transcriber,
+			ImageMetric:  *metric,
+			ImageWeights: helpers.DefaultImageWeights,
+			Params:       helpers.DefaultMelodyParams,
+		})
+		if err != nil {
+			log.Fatalf("Failed to evaluate: %v", err)
+		}
+		jsonPath, markdownPath, err := helpers.WriteEvaluationReport(report, *out)
+		if err != nil {
+			log.Fatalf("Failed to write the evaluation report: %v", err)
+		}
+		for _, summary := range report.Summaries {
+			log.Printf("%s: %d queries, top-1 %.3f, top-5 %.3f, top-9 %.3f, MRR %.3f, p50 %.1f ms\n",
+				summary.Kind, summary.Queries, summary.Top1, summary.Top5, summary.Top9, summary.MRR, summary.Latency.P50)
+		}
+		log.Printf("Wrote %s and %s\n", jsonPath, markdownPath)
+	default:
+		log.Fatalf("Unknown command %q, available commands: reindex, fingerprint, evaluate", name)
+	}
+}
@@ -1,10 +1,29 @@
 package models
 
+import "bos/pablo/types"
+
 type Album struct {
 	ID          uint   `gorm:"primaryKey"`
 	Name        string `gorm:"not null"`
 	PicFilePath string `gorm:"not null"`
 	Flattened   string `gorm:"not null"`
 
+	// How the flattened vector was computed, nil for albums from before it was recorded
+	FeatureMeta *types.ImageFeatureMeta `gorm:"serializer:json;type:jsonb"`
+
+	// Coordinates of the cover in the album PCA model it was projected with
+	Projection []float64 `gorm:"serializer:json;type:jsonb" json:"-"`
+	PCAModelID *string   `gorm:"index" json:"-"`
+
+	// Perceptual hashes of the cover, stored as the bits of helpers.ImageHashes
+	AverageHash    int64 `gorm:"not null;default:0" json:"-"`
+	DifferenceHash int64 `gorm:"not null;default:0" json:"-"`
+	PerceptualHash int64 `gorm:"not null;default:0" json:"-"`
+	HashVersion    int   `gorm:"not null;default:0;index" json:"-"` // 0 until the cover is hashed
+
+	// Color features of the cover, nil until they are extracted
+	Colors       *types.ColorFeatures `gorm:"serializer:json;type:jsonb" json:"-"`
+	ColorVersion int                  `gorm:"not null;default:0;index" json:"-"` // Colors.Version, kept in a column to filter on
+
 	Songs []Song
 }
@@ -1,13 +1,67 @@
 package models
 
 import (
+	"log"
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// migrationStep is a schema change AutoMigrate cannot express, such as dropping a table
+type migrationStep struct {
+	Name string
+	Run  func(tx *gorm.DB) error
+}
+
+// migrationSteps run once each, in order. Append new steps, never rename or reorder them.
+var migrationSteps = []migrationStep{
+	// Pitch n-grams used to be stored per song but were never queried, the interval
+	// postings replaced them
+	{"0001_drop_song_ngrams", func(tx *gorm.DB) error {
+		if !tx.Migrator().HasTable("song_ngrams") {
+			return nil
+		}
+		return tx.Migrator().DropTable("song_ngrams")
+	}},
+}
+
 // AutoMigrateAll will migrate all registered models
 func AutoMigrateAll(db *gorm.DB) {
 	db.AutoMigrate(
 		&Album{},
 		&Song{},
+		&SongFeature{},
+		&IntervalPosting{},
+		&SongFingerprint{},
+		&SchemaMigration{},
 	)
+
+	runMigrationSteps(db)
+}
+
+// runMigrationSteps applies the steps not recorded in schema_migrations yet, each in a
+// transaction with its record, and stops at the first failure so later steps can rely on it
+func runMigrationSteps(db *gorm.DB) {
+	for _, step := range migrationSteps {
+		var applied int64
+		if err := db.Model(&SchemaMigration{}).Where("name = ?", step.Name).Count(&applied).Error; err != nil {
+			log.Printf("Failed to check migration %s: %v\n", step.Name, err)
+			return
+		}
+		if applied > 0 {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := step.Run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Name: step.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			log.Printf("Failed to apply migration %s: %v\n", step.Name, err)
+			return
+		}
+		log.Printf("Applied migration %s\n", step.Name)
+	}
 }
@@ -0,0 +1,9 @@
+package models
+
+import "time"
+
+// SchemaMigration records a one-off migration step that has already been applied
+type SchemaMigration struct {
+	Name      string `gorm:"primaryKey"`
+	AppliedAt time.Time
+}
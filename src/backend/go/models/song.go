@@ -7,6 +7,21 @@ type Song struct {
 	AudioFilePathMidi string `gorm:"not null"`
 	MidiJSON          string `gorm:"not null"`
 
+	// Track the melody is extracted from, nil to pick it automatically
+	MelodyTrack *int
+	// Notes format version the melody was extracted with, 0 until it has been extracted
+	NotesVersion int `gorm:"not null;default:0;index" json:"-"`
+
+	// Analysis computed at ingest, nil until the song has been analyzed
+	EstimatedKey  *string `gorm:"index"`
+	KeyConfidence *float64
+	Tempo         *float64 `gorm:"index"`
+	TimeSignature *string  `gorm:"index"`
+	Duration      *float64 `gorm:"index"`
+	NoteCount     *int
+	PitchMin      *int
+	PitchMax      *int
+
 	AlbumID *uint
 	Album   Album
 }
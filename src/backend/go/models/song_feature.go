@@ -0,0 +1,23 @@
+package models
+
+import "bos/pablo/types"
+
+// SongFeature stores the sliding-window melody histograms of a song at one window length
+type SongFeature struct {
+	ID         uint                  `gorm:"primaryKey"`
+	SongID     uint                  `gorm:"not null;index"`
+	Version    int                   `gorm:"not null;index"`
+	WindowSize int                   `gorm:"not null;index"`
+	Stride     int                   `gorm:"not null"`
+	NoteCount  int                   `gorm:"not null"`
+	Windows    []types.FeatureWindow `gorm:"serializer:json;type:jsonb"`
+}
+
+// IntervalPosting lists where a quantized interval n-gram occurs in a song
+type IntervalPosting struct {
+	ID      uint   `gorm:"primaryKey"`
+	Gram    string `gorm:"not null;index"`
+	SongID  uint   `gorm:"not null;index"`
+	Version int    `gorm:"not null;index"`
+	Offsets []int  `gorm:"serializer:json;type:jsonb"`
+}
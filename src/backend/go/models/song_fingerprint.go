@@ -0,0 +1,10 @@
+package models
+
+// SongFingerprint stores one landmark hash of a song's audio and the frame its first peak is in
+type SongFingerprint struct {
+	ID      uint  `gorm:"primaryKey"`
+	SongID  uint  `gorm:"not null;index"`
+	Version int   `gorm:"not null;index"`
+	Hash    int64 `gorm:"not null;index"`
+	Frame   int   `gorm:"not null"`
+}
@@ -15,4 +15,5 @@ func SetupAlbumsRoutes(router *gin.RouterGroup, db *gorm.DB) {
 	albums.GET("/:id/:songId", controllers.AssignSongToAlbum(db))
 	albums.POST("/upload", controllers.UploadAndCreateAlbum(db))
 	albums.POST("/search-by-image", controllers.SearchByImage(db))
+	albums.POST("/pca/rebuild", controllers.RebuildAlbumPCA(db))
 }
@@ -1,11 +1,13 @@
 package routes
 
 import (
+	"bos/pablo/helpers"
+
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-func SetupRouter(router *gin.Engine, db *gorm.DB) {
+func SetupRouter(router *gin.Engine, db *gorm.DB, converters helpers.ConverterSet) {
 	router.GET("/", func(c *gin.Context) {
 		c.String(200, "Running...")
 	})
@@ -13,7 +15,7 @@ func SetupRouter(router *gin.Engine, db *gorm.DB) {
 	api := router.Group("/api")
 	{
 		SetupUploadRoutes(api, db)
-		SetupSongsRoutes(api, db)
+		SetupSongsRoutes(api, db, converters)
 		SetupAlbumsRoutes(api, db)
 	}
 
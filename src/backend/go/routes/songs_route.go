@@ -2,16 +2,22 @@ package routes
 
 import (
 	"bos/pablo/controllers"
+	"bos/pablo/helpers"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-func SetupSongsRoutes(router *gin.RouterGroup, db *gorm.DB) {
+func SetupSongsRoutes(router *gin.RouterGroup, db *gorm.DB, converters helpers.ConverterSet) {
 	router.GET("/songs", controllers.GetAllSongsWithPagination(db))
 
 	songs := router.Group("/songs")
 	songs.GET("/unassociated", controllers.GetUnassociatedSongs(db))
-	songs.POST("/upload", controllers.UploadAndCreateSong(db))
-	songs.POST("/search-by-audio", controllers.SearchByHumming(db))
+	songs.POST("/upload", controllers.UploadAndCreateSong(db, converters))
+	songs.PUT("/:id/melody-track", controllers.SetSongMelodyTrack(db))
+	songs.POST("/search-by-audio", controllers.SearchByHumming(db, converters))
+	songs.POST("/search-by-notes", controllers.SearchByNotes(db))
+	songs.POST("/search-by-tapping", controllers.SearchByTapping(db))
+	songs.POST("/search-by-recording", controllers.SearchByRecording(db))
+	songs.GET("/search-stream", controllers.StreamHummingSearch(db))
 }
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ExtractAlbumColors computes the color features of an album cover and stores them on the album
+func ExtractAlbumColors(db *gorm.DB, album *models.Album) error {
+	colors, err := helpers.ExtractColorFeaturesFile(album.PicFilePath)
+	if err != nil {
+		return err
+	}
+	album.Colors = &colors
+	album.ColorVersion = colors.Version
+	return db.Model(album).Select("Colors", "ColorVersion").Updates(album).Error
+}
+
+// ExtractMissingAlbumColors extracts the color features of every album stored before color
+// search existed or extracted with an older version
+func ExtractMissingAlbumColors(db *gorm.DB) error {
+	var albums []models.Album
+	err := db.Select("id", "name", "pic_file_path").
+		Where("color_version <> ?", helpers.ColorFeatureVersion).
+		Find(&albums).Error
+	if err != nil {
+		return err
+	}
+
+	extracted := 0
+	for i := range albums {
+		if err := ExtractAlbumColors(db, &albums[i]); err != nil {
+			log.Printf("Failed to extract the colors of album %d (%s): %v\n", albums[i].ID, albums[i].Name, err)
+			continue
+		}
+		extracted++
+	}
+	if extracted > 0 {
+		log.Printf("Extracted the colors of %d albums\n", extracted)
+	}
+	return nil
+}
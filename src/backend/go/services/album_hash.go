@@ -0,0 +1,154 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"log"
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// DefaultHashMaxDistance is how many of the 64 hash bits a near-duplicate cover may differ in
+const DefaultHashMaxDistance = 10
+
+// The BK-trees of the album hashes by hash name, loaded from the database on first use
+var (
+	hashIndexMu sync.Mutex
+	hashIndex   map[string]*helpers.BKTree
+)
+
+// HashAlbum computes the perceptual hashes of an album cover, stores them on the album and
+// adds them to the hash index
+func HashAlbum(db *gorm.DB, album *models.Album) error {
+	hashes, err := helpers.HashImageFile(album.PicFilePath)
+	if err != nil {
+		return err
+	}
+	album.AverageHash = int64(hashes.Average)
+	album.DifferenceHash = int64(hashes.Difference)
+	album.PerceptualHash = int64(hashes.Perceptual)
+	album.HashVersion = helpers.ImageHashVersion
+	if err := db.Model(album).Select("AverageHash", "DifferenceHash", "PerceptualHash", "HashVersion").Updates(album).Error; err != nil {
+		return err
+	}
+
+	// An index that is not loaded yet reads the album with all others
+	hashIndexMu.Lock()
+	defer hashIndexMu.Unlock()
+	if hashIndex != nil {
+		indexAlbumHashes(hashIndex, album)
+	}
+	return nil
+}
+
+// HashMissingAlbums hashes every album stored before perceptual hashes existed or hashed
+// with an older version
+func HashMissingAlbums(db *gorm.DB) error {
+	var albums []models.Album
+	if err := db.Where("hash_version <> ?", helpers.ImageHashVersion).Find(&albums).Error; err != nil {
+		return err
+	}
+
+	hashed := 0
+	for i := range albums {
+		if err := HashAlbum(db, &albums[i]); err != nil {
+			log.Printf("Failed to hash album %d (%s): %v\n", albums[i].ID, albums[i].Name, err)
+			continue
+		}
+		hashed++
+	}
+	if hashed > 0 {
+		log.Printf("Hashed %d albums\n", hashed)
+	}
+	return nil
+}
+
+// SearchAlbumsByHash finds the albums whose named hash is within maxDistance bits of the
+// query's, closest first. Similarity is the share of equal bits.
+func SearchAlbumsByHash(db *gorm.DB, query helpers.ImageHashes, hashName string, maxDistance, topK int) ([]AlbumResult, error) {
+	hash, err := query.Get(hashName)
+	if err != nil {
+		return nil, err
+	}
+
+	hashIndexMu.Lock()
+	if hashIndex == nil {
+		if err := loadHashIndex(db); err != nil {
+			hashIndexMu.Unlock()
+			return nil, err
+		}
+	}
+	matches := hashIndex[hashName].Search(hash, maxDistance)
+	hashIndexMu.Unlock()
+
+	if len(matches) > topK {
+		matches = matches[:topK]
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	var albums []models.Album
+	if err := db.Preload("Songs").Find(&albums, ids).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.Album, len(albums))
+	for _, album := range albums {
+		byID[album.ID] = album
+	}
+
+	// Deleted albums are still in the index, they are skipped here
+	results := make([]AlbumResult, 0, len(matches))
+	for _, match := range matches {
+		album, ok := byID[match.ID]
+		if !ok {
+			continue
+		}
+		distance := match.Distance
+		results = append(results, AlbumResult{
+			ID:          album.ID,
+			Name:        album.Name,
+			PicFilePath: album.PicFilePath,
+			Songs:       album.Songs,
+			Similarity:  1 - float64(distance)/helpers.HashBits,
+			Distance:    &distance,
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+	return results, nil
+}
+
+// loadHashIndex builds the BK-trees from the hashed albums. The caller holds hashIndexMu.
+func loadHashIndex(db *gorm.DB) error {
+	var albums []models.Album
+	err := db.Select("id", "average_hash", "difference_hash", "perceptual_hash").
+		Where("hash_version = ?", helpers.ImageHashVersion).Find(&albums).Error
+	if err != nil {
+		return err
+	}
+
+	index := map[string]*helpers.BKTree{
+		helpers.HashAverage:    {},
+		helpers.HashDifference: {},
+		helpers.HashPerceptual: {},
+	}
+	for i := range albums {
+		indexAlbumHashes(index, &albums[i])
+	}
+	hashIndex = index
+	return nil
+}
+
+func indexAlbumHashes(index map[string]*helpers.BKTree, album *models.Album) {
+	index[helpers.HashAverage].Insert(uint64(album.AverageHash), album.ID)
+	index[helpers.HashDifference].Insert(uint64(album.DifferenceHash), album.ID)
+	index[helpers.HashPerceptual].Insert(uint64(album.PerceptualHash), album.ID)
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// pcaModelPath is where the album PCA model is stored
+const pcaModelPath = "public/uploads/pca/model.json"
+
+// DefaultPCAComponents is the number of components fitted when PCA_COMPONENTS is not set
+const DefaultPCAComponents = 20
+
+// maxPCAComponents caps the components of a model
+const maxPCAComponents = 200
+
+// The album PCA model in use, loaded from disk on first use
+var (
+	pcaMu     sync.RWMutex
+	pcaModel  *helpers.PCAModel
+	pcaLoaded bool
+)
+
+// PCAComponents returns the number of components to fit, from PCA_COMPONENTS
+func PCAComponents() int {
+	components, err := strconv.Atoi(os.Getenv("PCA_COMPONENTS"))
+	if err != nil || components < 1 || components > maxPCAComponents {
+		return DefaultPCAComponents
+	}
+	return components
+}
+
+// CurrentPCAModel returns the album PCA model, or nil when none has been built yet
+func CurrentPCAModel() *helpers.PCAModel {
+	pcaMu.RLock()
+	if pcaLoaded {
+		defer pcaMu.RUnlock()
+		return pcaModel
+	}
+	pcaMu.RUnlock()
+
+	pcaMu.Lock()
+	defer pcaMu.Unlock()
+	if !pcaLoaded {
+		model, err := helpers.LoadPCAModel(pcaModelPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to load the album PCA model:", err)
+		}
+		pcaModel, pcaLoaded = model, true
+	}
+	return pcaModel
+}
+
+// RebuildAlbumPCA fits a new PCA model with up to components components over the covers of
+// every album, stores it and the projection of every album, and starts using it
+func RebuildAlbumPCA(db *gorm.DB, components int) (*helpers.PCAModel, error) {
+	if components < 1 || components > maxPCAComponents {
+		return nil, errors.New("components must be between 1 and " + strconv.Itoa(maxPCAComponents))
+	}
+
+	var albums []models.Album
+	if err := db.Find(&albums).Error; err != nil {
+		return nil, err
+	}
+
+	var fitted []models.Album
+	var vectors [][]float64
+	for _, album := range albums {
+		vector, err := loadFlattenedImage(album.Flattened)
+		if err != nil {
+			log.Printf("Skipping album %d (%s) in the PCA model: %v\n", album.ID, album.Name, err)
+			continue
+		}
+		fitted = append(fitted, album)
+		vectors = append(vectors, vector)
+	}
+
+	model, err := helpers.FitPCAModel(vectors, components)
+	if err != nil {
+		return nil, err
+	}
+	if err := helpers.SavePCAModel(pcaModelPath, model); err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range fitted {
+			projection, err := model.Project(vectors[i])
+			if err != nil {
+				return err
+			}
+			if err := saveProjection(tx, &fitted[i], model.ID, projection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pcaMu.Lock()
+	pcaModel, pcaLoaded = model, true
+	pcaMu.Unlock()
+	return model, nil
+}
+
+// ProjectAlbum stores the projection of an album cover in the current PCA model, if there is one
+func ProjectAlbum(db *gorm.DB, album *models.Album) error {
+	model := CurrentPCAModel()
+	if model == nil {
+		return nil
+	}
+	vector, err := loadFlattenedImage(album.Flattened)
+	if err != nil {
+		return err
+	}
+	projection, err := model.Project(vector)
+	if err != nil {
+		return err
+	}
+	return saveProjection(db, album, model.ID, projection)
+}
+
+func saveProjection(db *gorm.DB, album *models.Album, modelID string, projection []float64) error {
+	album.Projection = projection
+	album.PCAModelID = &modelID
+	return db.Model(album).Select("Projection", "PCAModelID").Updates(album).Error
+}
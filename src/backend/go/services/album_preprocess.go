@@ -0,0 +1,79 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+// flattenedAlbumDir is where the flattened vectors of album covers are stored
+const flattenedAlbumDir = "public/uploads/flattened_albums"
+
+// ReprocessAlbum preprocesses an album cover again with the current options and stores its
+// flattened vector and feature metadata
+func ReprocessAlbum(db *gorm.DB, album *models.Album) error {
+	vector, meta, err := helpers.PreprocessImage(album.PicFilePath, helpers.DefaultImagePreprocessing)
+	if err != nil {
+		return err
+	}
+
+	if album.Flattened == "" {
+		album.Flattened = filepath.Join(flattenedAlbumDir, fmt.Sprintf("%s.json", filepath.Base(album.PicFilePath)))
+	}
+	if err := saveFlattenedImage(album.Flattened, vector); err != nil {
+		return err
+	}
+	album.FeatureMeta = &meta
+	return db.Model(album).Select("Flattened", "FeatureMeta").Updates(album).Error
+}
+
+// ReprocessStaleAlbums preprocesses every album whose cover was flattened with other options
+// than the current ones. The album PCA model is refitted afterwards, since the old vectors
+// shaped it.
+func ReprocessStaleAlbums(db *gorm.DB) error {
+	var albums []models.Album
+	if err := db.Find(&albums).Error; err != nil {
+		return err
+	}
+
+	reprocessed := 0
+	for i := range albums {
+		if albums[i].FeatureMeta != nil && albums[i].FeatureMeta.Preprocessing == helpers.DefaultImagePreprocessing {
+			continue
+		}
+		if err := ReprocessAlbum(db, &albums[i]); err != nil {
+			log.Printf("Failed to preprocess album %d (%s): %v\n", albums[i].ID, albums[i].Name, err)
+			continue
+		}
+		reprocessed++
+	}
+	if reprocessed == 0 {
+		return nil
+	}
+	log.Printf("Preprocessed %d albums again\n", reprocessed)
+
+	if model := CurrentPCAModel(); model != nil {
+		if _, err := RebuildAlbumPCA(db, len(model.Components)); err != nil {
+			return fmt.Errorf("failed to rebuild the album PCA model: %w", err)
+		}
+	}
+	return nil
+}
+
+// saveFlattenedImage writes the flattened vector of an album cover
+func saveFlattenedImage(path string, vector []float64) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(vector)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"bos/pablo/types"
+	"encoding/json"
+	"os"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// ImageSearchTopK is the maximum number of results of the album image search
+const ImageSearchTopK = 9
+
+// ImageSearchMinScore returns the score albums must beat to be returned when a search does
+// not set one. Only the PCA distance has a threshold of its own; the other metrics score on
+// scales of their own and keep the best topK albums instead.
+func ImageSearchMinScore(metric string) float64 {
+	if metric == helpers.PictureMetricPCA {
+		return 0.8
+	}
+	return 0
+}
+
+// AlbumResult is one album returned by an image search
+type AlbumResult struct {
+	ID          uint                     `json:"ID"`
+	Name        string                   `json:"Name"`
+	PicFilePath string                   `json:"PicFilePath"`
+	Songs       []models.Song            `json:"Songs"`
+	Similarity  float64                  `json:"similarity"`
+	Distance    *int                     `json:"distance,omitempty"` // Hamming distance of a hash search
+	Colors      *helpers.ColorSimilarity `json:"colors,omitempty"`   // color similarities when the weights use color
+}
+
+// SearchAlbumsByImage compares a preprocessed image with the cover of every album using the
+// named picture metric, and returns the topK albums scoring above minScore, best first. When
+// the weights use color, the color features of the query are compared too and the score is
+// the weighted mean of both.
+func SearchAlbumsByImage(db *gorm.DB, imageVector []float64, colors *types.ColorFeatures, metric string, weights helpers.ImageWeights, minScore float64, topK int) ([]AlbumResult, error) {
+	if err := helpers.LookupPictureMetric(metric); err != nil {
+		return nil, err
+	}
+
+	// Fetch all albums with their songs
+	var albums []models.Album
+	if err := db.Preload("Songs").Find(&albums).Error; err != nil {
+		return nil, err
+	}
+
+	// The pca metric compares projections on the album PCA model once one has been built.
+	// The query is projected once, albums from before the model are projected on the fly.
+	var model *helpers.PCAModel
+	var queryProjection []float64
+	if metric == helpers.PictureMetricPCA {
+		if model = CurrentPCAModel(); model != nil {
+			projection, err := model.Project(imageVector)
+			if err != nil {
+				return nil, err
+			}
+			queryProjection = projection
+		}
+	}
+
+	var results []AlbumResult
+	for _, album := range albums {
+		var similarity float64
+		if model != nil && album.PCAModelID != nil && *album.PCAModelID == model.ID {
+			similarity = model.Similarity(queryProjection, album.Projection)
+		} else {
+			if album.Flattened == "" {
+				continue
+			}
+			albumVector, err := loadFlattenedImage(album.Flattened)
+			if err != nil {
+				continue
+			}
+			if model != nil {
+				albumProjection, err := model.Project(albumVector)
+				if err != nil {
+					continue
+				}
+				similarity = model.Similarity(queryProjection, albumProjection)
+			} else if similarity, err = helpers.CheckPictureSimilarityWithMetric(imageVector, albumVector, metric); err != nil {
+				continue
+			}
+		}
+
+		// Albums whose color features are not extracted yet are scored on grayscale alone
+		var color *helpers.ColorSimilarity
+		if colors != nil && weights.UsesColor() && album.Colors != nil {
+			compared := helpers.CompareColorFeatures(*colors, *album.Colors)
+			color = &compared
+		}
+		similarity = weights.Combine(similarity, color)
+
+		if similarity > minScore {
+			results = append(results, AlbumResult{
+				ID:          album.ID,
+				Name:        album.Name,
+				PicFilePath: album.PicFilePath,
+				Songs:       album.Songs,
+				Similarity:  similarity,
+				Colors:      color,
+			})
+		}
+	}
+
+	// Best first, limited to the top k
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+	if len(results) > topK {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+// loadFlattenedImage reads the flattened vector of an album cover
+func loadFlattenedImage(path string) ([]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var vector []float64
+	err = json.NewDecoder(file).Decode(&vector)
+	return vector, err
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// evaluationDepth is how many results every query asks for, so correct answers ranked
+// below the top 9 still count towards the MRR
+const evaluationDepth = 100
+
+// EvaluationConfig selects the queries and the algorithms of an evaluation run
+type EvaluationConfig struct {
+	QueryDir     string
+	TruthPath    string // JSON object from query file name to the expected song or album
+	Matcher      string // melody matcher for audio queries
+	Transcriber  string // humming transcriber for audio queries, "" for the default
+	ImageMetric  string // picture metric for image queries
+	ImageWeights helpers.ImageWeights
+	Params       helpers.MelodyParams
+}
+
+// LoadGroundTruth reads a JSON object mapping query file names to the expected result, given
+// as a name or ID or as a list of names and IDs that all count as correct, e.g.
+// {"hum1.wav": "song.mid", "cover.jpg": ["Album", 3]}
+func LoadGroundTruth(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid ground truth %s: %w", path, err)
+	}
+
+	truth := make(map[string][]string, len(raw))
+	for file, value := range raw {
+		var values []any
+		if err := json.Unmarshal(value, &values); err != nil {
+			var single any
+			if err := json.Unmarshal(value, &single); err != nil {
+				return nil, fmt.Errorf("invalid ground truth for %s: %w", file, err)
+			}
+			values = []any{single}
+		}
+		for _, v := range values {
+			switch v := v.(type) {
+			case string:
+				truth[file] = append(truth[file], v)
+			case float64:
+				truth[file] = append(truth[file], fmt.Sprint(v))
+			default:
+				return nil, fmt.Errorf("ground truth for %s must be names or IDs", file)
+			}
+		}
+	}
+	return truth, nil
+}
+
+// RunEvaluation searches every labeled query in config.QueryDir against the current library
+// and reports where the expected song or album ranked. Audio, MIDI, notes and ABC files are
+// searched as melodies, image files as album covers.
+func RunEvaluation(db *gorm.DB, converters helpers.ConverterSet, config EvaluationConfig) (helpers.EvaluationReport, error) {
+	report := helpers.EvaluationReport{CreatedAt: time.Now()}
+
+	truth, err := LoadGroundTruth(config.TruthPath)
+	if err != nil {
+		return report, err
+	}
+	if _, err := NewMelodyMatcher(config.Matcher, config.Params); err != nil {
+		return report, err
+	}
+	if err := helpers.LookupPictureMetric(config.ImageMetric); err != nil {
+		return report, err
+	}
+	converter, err := converters.HummingConverter(config.Transcriber)
+	if err != nil {
+		return report, err
+	}
+
+	params := config.Params
+	params.TopK = evaluationDepth
+	report.Config = map[string]any{
+		"matcher":         config.Matcher,
+		"transcriber":     config.Transcriber,
+		"melodyParams":    config.Params,
+		"featureVersion":  helpers.DefaultFeatureParams.Version,
+		"imageMetric":     config.ImageMetric,
+		"imageWeights":    config.ImageWeights,
+		"imagePreprocess": helpers.DefaultImagePreprocessing,
+		"imageMinScore":   ImageSearchMinScore(config.ImageMetric),
+	}
+
+	files := make([]string, 0, len(truth))
+	for file := range truth {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		path := filepath.Join(config.QueryDir, file)
+		query := helpers.EvaluationQuery{File: file, Kind: evaluationKind(file), Expected: truth[file]}
+		if _, err := os.Stat(path); err != nil {
+			query.Error = err.Error()
+			report.Queries = append(report.Queries, query)
+			continue
+		}
+
+		startTime := time.Now()
+		var names [][]string
+		if query.Kind == "image" {
+			names, err = evaluateImage(db, path, config.ImageMetric, config.ImageWeights)
+		} else {
+			names, err = evaluateMelody(db, converter, path, config.Matcher, params)
+		}
+		query.LatencyMs = float64(time.Since(startTime).Microseconds()) / 1000
+
+		if err != nil {
+			query.Error = err.Error()
+		}
+		for i, candidates := range names {
+			if i == 0 {
+				query.TopResult = candidates[0]
+			}
+			if query.Rank == 0 && matchesExpected(candidates, query.Expected) {
+				query.Rank = i + 1
+			}
+		}
+		log.Printf("Evaluated %s: rank %d\n", file, query.Rank)
+		report.Queries = append(report.Queries, query)
+	}
+
+	report.Summaries = helpers.SummarizeEvaluation(report.Queries)
+	return report, nil
+}
+
+// evaluationKind tells image queries from melody queries by their extension
+func evaluationKind(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return "image"
+	default:
+		return "audio"
+	}
+}
+
+// evaluateMelody searches a melody query and returns, for every result, the names it can be
+// labeled by: its name, audio file name and ID
+func evaluateMelody(db *gorm.DB, converter helpers.Converter, path, matcher string, params helpers.MelodyParams) ([][]string, error) {
+	notes, err := evaluationNotes(converter, path)
+	if err != nil {
+		return nil, err
+	}
+	notes, _, err = helpers.CleanQuery(notes, helpers.DefaultQueryCleanupOptions)
+	var rejection *helpers.QueryRejection
+	if errors.As(err, &rejection) {
+		return nil, rejection
+	}
+
+	results, _, err := SearchMelody(db, notes, matcher, params, SongFilters{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([][]string, len(results))
+	for i, result := range results {
+		names[i] = []string{result.Name, filepath.Base(result.AudioFilePath), fmt.Sprint(result.ID)}
+	}
+	return names, nil
+}
+
+// evaluationNotes reads the notes of a melody query: notes files and ABC tunes directly,
+// MIDI and audio through the humming converter
+func evaluationNotes(converter helpers.Converter, path string) ([]helpers.NoteEvent, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return helpers.LoadNotesFromJSON(path)
+	case ".abc":
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return helpers.ParseABC(string(source))
+	}
+
+	midiPath, jsonPath, err := converter.Convert(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, converted := range []string{midiPath, jsonPath} {
+			if converted != path {
+				os.Remove(converted)
+			}
+		}
+	}()
+	return helpers.LoadNotesFromJSON(jsonPath)
+}
+
+// evaluateImage searches an image query and returns, for every result, the names it can be
+// labeled by: its name, cover file name and ID
+func evaluateImage(db *gorm.DB, path, metric string, weights helpers.ImageWeights) ([][]string, error) {
+	vector, _, err := helpers.PreprocessImage(path, helpers.DefaultImagePreprocessing)
+	if err != nil {
+		return nil, err
+	}
+	var colors *types.ColorFeatures
+	if weights.UsesColor() {
+		extracted, err := helpers.ExtractColorFeaturesFile(path)
+		if err != nil {
+			return nil, err
+		}
+		colors = &extracted
+	}
+	results, err := SearchAlbumsByImage(db, vector, colors, metric, weights, ImageSearchMinScore(metric), evaluationDepth)
+	if err != nil {
+		return nil, err
+	}
+	names := make([][]string, len(results))
+	for i, result := range results {
+		names[i] = []string{result.Name, filepath.Base(result.PicFilePath), fmt.Sprint(result.ID)}
+	}
+	return names, nil
+}
+
+// matchesExpected compares names case-insensitively, with or without their extension
+func matchesExpected(names, expected []string) bool {
+	normalize := func(name string) string {
+		name = strings.ToLower(strings.TrimSpace(name))
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	for _, name := range names {
+		for _, want := range expected {
+			if normalize(name) == normalize(want) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"errors"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotFingerprintable is returned for songs whose audio is not a WAV file
+var ErrNotFingerprintable = errors.New("only songs uploaded as WAV audio can be fingerprinted")
+
+// minRecordingMatches is the number of fingerprints that must agree on an offset before a
+// song counts as found
+const minRecordingMatches = 5
+
+// RecordingResult is one song returned by a recording search
+type RecordingResult struct {
+	ID            uint    `json:"ID"`
+	Name          string  `json:"Name"`
+	AudioFilePath string  `json:"AudioFilePath"`
+	AlbumID       *uint   `json:"AlbumID,omitempty"`
+	Matches       int     `json:"Matches"`       // fingerprints agreeing on the offset
+	Confidence    float64 `json:"Confidence"`    // share of the recording's fingerprints that matched
+	OffsetSeconds float64 `json:"OffsetSeconds"` // where in the song the recording starts
+}
+
+// FingerprintSong fingerprints the WAV audio of a song and stores the hashes, replacing any
+// previous ones. It returns the number of fingerprints stored.
+func FingerprintSong(db *gorm.DB, song *models.Song) (int, error) {
+	if !helpers.IsWavFile(song.AudioFilePath) {
+		return 0, ErrNotFingerprintable
+	}
+	opts := helpers.DefaultFingerprintOptions
+	prints, err := helpers.FingerprintWavFile(song.AudioFilePath, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make([]models.SongFingerprint, len(prints))
+	for i, fingerprint := range prints {
+		rows[i] = models.SongFingerprint{SongID: song.ID, Version: opts.Version, Hash: int64(fingerprint.Hash), Frame: fingerprint.Frame}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("song_id = ?", song.ID).Delete(&models.SongFingerprint{}).Error; err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			return tx.CreateInBatches(&rows, 1000).Error
+		}
+		return nil
+	})
+	return len(prints), err
+}
+
+// FingerprintSongs fingerprints every WAV song without fingerprints of the current version,
+// or every WAV song when force is set. It returns the number of songs fingerprinted.
+func FingerprintSongs(db *gorm.DB, force bool) (int, error) {
+	var songs []models.Song
+	if err := db.Find(&songs).Error; err != nil {
+		return 0, err
+	}
+
+	current := map[uint]bool{}
+	if !force {
+		var songIDs []uint
+		err := db.Model(&models.SongFingerprint{}).
+			Where("version = ?", helpers.DefaultFingerprintOptions.Version).
+			Distinct().Pluck("song_id", &songIDs).Error
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range songIDs {
+			current[id] = true
+		}
+	}
+
+	fingerprinted := 0
+	for i := range songs {
+		if current[songs[i].ID] || !helpers.IsWavFile(songs[i].AudioFilePath) {
+			continue
+		}
+		if _, err := FingerprintSong(db, &songs[i]); err != nil {
+			log.Printf("Failed to fingerprint song %d (%s): %v\n", songs[i].ID, songs[i].Name, err)
+			continue
+		}
+		fingerprinted++
+	}
+	return fingerprinted, nil
+}
+
+// SearchRecording looks the fingerprints of a recording up in the stored hashes and returns
+// up to topK songs in which enough of them line up at one offset, best first
+func SearchRecording(db *gorm.DB, prints []helpers.Fingerprint, topK int) ([]RecordingResult, error) {
+	opts := helpers.DefaultFingerprintOptions
+
+	// Look the distinct hashes up in batches to stay below the query parameter limit
+	seen := map[int64]bool{}
+	var hashes []int64
+	for _, fingerprint := range prints {
+		if hash := int64(fingerprint.Hash); !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+
+	hits := map[uint32][]helpers.FingerprintHit{}
+	for start := 0; start < len(hashes); start += 1000 {
+		var rows []models.SongFingerprint
+		err := db.Select("song_id", "hash", "frame").
+			Where("version = ? AND hash IN ?", opts.Version, hashes[start:min(start+1000, len(hashes))]).
+			Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			hits[uint32(row.Hash)] = append(hits[uint32(row.Hash)], helpers.FingerprintHit{SongID: row.SongID, Frame: row.Frame})
+		}
+	}
+
+	var matches []helpers.RecordingMatch
+	for _, match := range helpers.AlignFingerprints(prints, hits) {
+		if match.Matches >= minRecordingMatches && len(matches) < topK {
+			matches = append(matches, match)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	songIDs := make([]uint, len(matches))
+	for i, match := range matches {
+		songIDs[i] = match.SongID
+	}
+	var songs []models.Song
+	if err := db.Find(&songs, songIDs).Error; err != nil {
+		return nil, err
+	}
+	songsByID := make(map[uint]models.Song, len(songs))
+	for _, song := range songs {
+		songsByID[song.ID] = song
+	}
+
+	var results []RecordingResult
+	for _, match := range matches {
+		song, ok := songsByID[match.SongID]
+		if !ok {
+			continue
+		}
+		results = append(results, RecordingResult{
+			ID:            song.ID,
+			Name:          song.Name,
+			AudioFilePath: song.AudioFilePath,
+			AlbumID:       song.AlbumID,
+			Matches:       match.Matches,
+			Confidence:    float64(match.Matches) / float64(len(prints)),
+			OffsetSeconds: float64(match.Offset) * opts.FrameSeconds(),
+		})
+	}
+	return results, nil
+}
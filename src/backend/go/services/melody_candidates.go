@@ -0,0 +1,122 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxCandidateSongs   = 100 // songs kept for re-ranking
+	maxCandidateOffsets = 3   // diagonals kept per song
+	minCandidateHits    = 2   // n-gram hits needed on one diagonal
+	diagonalBucket      = 4   // notes of slack for inserted or dropped humming notes
+)
+
+// MelodyCandidate is a song shortlisted by the interval n-gram index together with the
+// note offsets where the query most likely starts
+type MelodyCandidate struct {
+	SongID  uint
+	Hits    int
+	Offsets []int
+}
+
+// FindMelodyCandidates looks up the query's interval n-grams in the inverted index and
+// votes for (song, start offset) diagonals. It returns nil when the query is too short
+// to produce any n-gram or no diagonal gets enough hits, in which case every song has to
+// be scored. When songIDs is not nil only those songs are considered.
+func FindMelodyCandidates(db *gorm.DB, query []helpers.NoteEvent, songIDs []uint) (map[uint]MelodyCandidate, error) {
+	params := helpers.DefaultFeatureParams
+	queryNgrams := helpers.BuildIntervalNgrams(helpers.Pitches(query), params.IntervalNgram)
+	if len(queryNgrams) == 0 {
+		return nil, nil
+	}
+
+	queryOffsets := map[string][]int{}
+	for _, ngram := range queryNgrams {
+		queryOffsets[ngram.Gram] = append(queryOffsets[ngram.Gram], ngram.Offset)
+	}
+	grams := make([]string, 0, len(queryOffsets))
+	for gram := range queryOffsets {
+		grams = append(grams, gram)
+	}
+
+	var postings []models.IntervalPosting
+	postingQuery := db.Where("version = ? AND gram IN ?", params.Version, grams)
+	if songIDs != nil {
+		if len(songIDs) == 0 {
+			return nil, nil
+		}
+		postingQuery = postingQuery.Where("song_id IN ?", songIDs)
+	}
+	if err := postingQuery.Find(&postings).Error; err != nil {
+		return nil, err
+	}
+
+	// Every matching n-gram votes for the song offset where the query would start
+	votes := map[uint]map[int]int{}
+	for _, posting := range postings {
+		if votes[posting.SongID] == nil {
+			votes[posting.SongID] = map[int]int{}
+		}
+		for _, songOffset := range posting.Offsets {
+			for _, queryOffset := range queryOffsets[posting.Gram] {
+				start := songOffset - queryOffset
+				if start < 0 {
+					start = 0
+				}
+				votes[posting.SongID][start/diagonalBucket]++
+			}
+		}
+	}
+
+	var ranked []MelodyCandidate
+	for songID, diagonals := range votes {
+		type diagonal struct{ bucket, hits int }
+		var best []diagonal
+		for bucket, hits := range diagonals {
+			if hits >= minCandidateHits {
+				best = append(best, diagonal{bucket, hits})
+			}
+		}
+		if len(best) == 0 {
+			continue
+		}
+		sort.Slice(best, func(i, j int) bool {
+			if best[i].hits != best[j].hits {
+				return best[i].hits > best[j].hits
+			}
+			return best[i].bucket < best[j].bucket
+		})
+		if len(best) > maxCandidateOffsets {
+			best = best[:maxCandidateOffsets]
+		}
+
+		candidate := MelodyCandidate{SongID: songID, Hits: best[0].hits}
+		for _, d := range best {
+			candidate.Offsets = append(candidate.Offsets, d.bucket*diagonalBucket)
+		}
+		ranked = append(ranked, candidate)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits != ranked[j].Hits {
+			return ranked[i].Hits > ranked[j].Hits
+		}
+		return ranked[i].SongID < ranked[j].SongID
+	})
+	if len(ranked) == 0 {
+		return nil, nil
+	}
+	if len(ranked) > maxCandidateSongs {
+		ranked = ranked[:maxCandidateSongs]
+	}
+
+	candidates := make(map[uint]MelodyCandidate, len(ranked))
+	for _, candidate := range ranked {
+		candidates[candidate.SongID] = candidate
+	}
+	return candidates, nil
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+
+	"gorm.io/gorm"
+)
+
+// ExtractSongMelody extracts the melody of a song into its notes file, using the song's
+// manual track override when it has one, and records the notes version it was extracted with
+func ExtractSongMelody(db *gorm.DB, song *models.Song) (*helpers.NotesDocument, error) {
+	track := -1
+	if song.MelodyTrack != nil {
+		track = *song.MelodyTrack
+	}
+	doc, err := helpers.ExtractMelodyToJSON(song.MidiJSON, track)
+	if err != nil {
+		return nil, err
+	}
+	return doc, recordNotesVersion(db, song)
+}
+
+// recordNotesVersion marks the song's notes file as upgraded to the current format with its
+// melody extracted, so MigrateNotesJSON skips it
+func recordNotesVersion(db *gorm.DB, song *models.Song) error {
+	song.NotesVersion = helpers.NotesFormatVersion
+	return db.Model(song).Update("notes_version", song.NotesVersion).Error
+}
+
+// SetMelodyTrack overrides the melody track of a song, or goes back to automatic selection
+// when track is nil, then re-extracts and reindexes its melody. The override is only saved
+// when the extraction succeeds, so an unusable track leaves the song unchanged.
+func SetMelodyTrack(db *gorm.DB, song *models.Song, track *int) (*helpers.NotesDocument, error) {
+	previous := song.MelodyTrack
+	song.MelodyTrack = track
+	doc, err := ExtractSongMelody(db, song)
+	if err != nil {
+		song.MelodyTrack = previous
+		return nil, err
+	}
+
+	if err := db.Model(song).Update("melody_track", track).Error; err != nil {
+		return nil, err
+	}
+	return doc, IndexSong(db, song)
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"bos/pablo/types"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// IndexSong computes the features of a song's extracted melody and stores them, replacing any previous ones
+func IndexSong(db *gorm.DB, song *models.Song) error {
+	notes, err := helpers.LoadMelodyFromJSON(song.MidiJSON)
+	if err != nil {
+		return err
+	}
+	params := helpers.DefaultFeatureParams
+
+	var features []models.SongFeature
+	for _, windowSize := range params.WindowSizes {
+		stride := params.Stride(windowSize)
+		features = append(features, models.SongFeature{
+			SongID:     song.ID,
+			Version:    params.Version,
+			WindowSize: windowSize,
+			Stride:     stride,
+			NoteCount:  len(notes),
+			Windows:    helpers.BuildFeatureWindows(notes, windowSize, stride),
+		})
+	}
+
+	offsetsByGram := map[string][]int{}
+	for _, ngram := range helpers.BuildIntervalNgrams(helpers.Pitches(notes), params.IntervalNgram) {
+		offsetsByGram[ngram.Gram] = append(offsetsByGram[ngram.Gram], ngram.Offset)
+	}
+	var postings []models.IntervalPosting
+	for gram, offsets := range offsetsByGram {
+		postings = append(postings, models.IntervalPosting{Gram: gram, SongID: song.ID, Version: params.Version, Offsets: offsets})
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("song_id = ?", song.ID).Delete(&models.SongFeature{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("song_id = ?", song.ID).Delete(&models.IntervalPosting{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&features).Error; err != nil {
+			return err
+		}
+		if len(postings) > 0 {
+			if err := tx.CreateInBatches(&postings, 500).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReindexSongs rebuilds the melody features of every song whose index is missing or was
+// built with older feature parameters, or of every song when force is set.
+// It returns the number of songs that were indexed.
+func ReindexSongs(db *gorm.DB, force bool) (int, error) {
+	var songs []models.Song
+	if err := db.Find(&songs).Error; err != nil {
+		return 0, err
+	}
+
+	current := map[uint]bool{}
+	if !force {
+		var err error
+		if current, err = IndexedSongIDs(db); err != nil {
+			return 0, err
+		}
+	}
+
+	indexed := 0
+	for i := range songs {
+		if current[songs[i].ID] {
+			continue
+		}
+		if err := IndexSong(db, &songs[i]); err != nil {
+			log.Printf("Failed to index song %d (%s): %v\n", songs[i].ID, songs[i].Name, err)
+			continue
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// IndexedSongIDs returns the songs whose melody features match the current feature parameters
+func IndexedSongIDs(db *gorm.DB) (map[uint]bool, error) {
+	var songIDs []uint
+	err := db.Model(&models.SongFeature{}).
+		Where("version = ?", helpers.DefaultFeatureParams.Version).
+		Distinct().Pluck("song_id", &songIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := make(map[uint]bool, len(songIDs))
+	for _, id := range songIDs {
+		indexed[id] = true
+	}
+	return indexed, nil
+}
+
+// ScoreSongsFromIndex scores the query against the indexed window sizes closest to the
+// window lengths asked for by params and returns the best match of every indexed song. The
+// fixed window sizes and strides make these scores an approximation of MatchMelodyHistogram,
+// good for ranking indexed songs against each other but not against songs scored from notes. When
+// candidates is not nil only those songs are scored, and only near their candidate offsets.
+// When songIDs is not nil only those songs are scored as well.
+func ScoreSongsFromIndex(db *gorm.DB, query []helpers.NoteEvent, candidates map[uint]MelodyCandidate, songIDs []uint, params helpers.MelodyParams) (map[uint]helpers.MelodyMatch, error) {
+	featureParams := helpers.DefaultFeatureParams
+	var windowSizes []int
+	for _, size := range params.WindowSizes(len(query)) {
+		windowSizes = append(windowSizes, featureParams.NearestWindowSize(size))
+	}
+
+	var features []models.SongFeature
+	featureQuery := db.Where("version = ? AND window_size IN ?", featureParams.Version, windowSizes)
+	if candidates != nil {
+		candidateIDs := make([]uint, 0, len(candidates))
+		for songID := range candidates {
+			candidateIDs = append(candidateIDs, songID)
+		}
+		featureQuery = featureQuery.Where("song_id IN ?", candidateIDs)
+	} else if songIDs != nil {
+		if len(songIDs) == 0 {
+			return map[uint]helpers.MelodyMatch{}, nil
+		}
+		featureQuery = featureQuery.Where("song_id IN ?", songIDs)
+	}
+	if err := featureQuery.Find(&features).Error; err != nil {
+		return nil, err
+	}
+
+	matches := make(map[uint]helpers.MelodyMatch, len(features))
+	for _, feature := range features {
+		windows := helpers.WindowsWithStep(feature.Windows, params.WindowStep)
+		if candidate, ok := candidates[feature.SongID]; ok {
+			windows = windowsNear(windows, candidate.Offsets, feature.WindowSize/2+feature.Stride)
+		}
+		match := helpers.ScoreFeatureWindows(query, windows, feature.WindowSize, feature.NoteCount, params)
+		if current, ok := matches[feature.SongID]; !ok || match.Score > current.Score {
+			matches[feature.SongID] = match
+		}
+	}
+	return matches, nil
+}
+
+func windowsNear(windows []types.FeatureWindow, offsets []int, radius int) []types.FeatureWindow {
+	var near []types.FeatureWindow
+	for _, window := range windows {
+		for _, offset := range offsets {
+			if window.Offset >= offset-radius && window.Offset <= offset+radius {
+				near = append(near, window)
+				break
+			}
+		}
+	}
+	return near
+}
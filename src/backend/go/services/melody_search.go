@@ -0,0 +1,220 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// MelodyResult is one song returned by a melody search
+type MelodyResult struct {
+	ID              uint    `json:"ID"`
+	Name            string  `json:"Name"`
+	AudioFilePath   string  `json:"AudioFilePath"`
+	AlbumID         *uint   `json:"AlbumID,omitempty"`
+	SimilarityScore float64 `json:"SimilarityScore"`
+
+	// Where the query matched and how each feature scored
+	Match helpers.MelodyMatch `json:"Match"`
+}
+
+// indexShortlistFactor times params.TopK indexed songs with the best index scores are scored
+// from their notes
+const indexShortlistFactor = 4
+
+// MelodyMatcher scores a query against the melody of one song
+type MelodyMatcher func(query, song []helpers.NoteEvent) helpers.MelodyMatch
+
+// NewMelodyMatcher returns the matcher called name, "histogram", "dtw" or "alignment"
+func NewMelodyMatcher(name string, params helpers.MelodyParams) (MelodyMatcher, error) {
+	switch name {
+	case "histogram":
+		return func(query, song []helpers.NoteEvent) helpers.MelodyMatch {
+			return helpers.MatchMelodyHistogram(query, song, params)
+		}, nil
+	case "dtw":
+		return func(query, song []helpers.NoteEvent) helpers.MelodyMatch {
+			return helpers.MatchMelodyDTW(query, song, helpers.DefaultDTWOptions)
+		}, nil
+	case "alignment":
+		return func(query, song []helpers.NoteEvent) helpers.MelodyMatch {
+			return helpers.MatchMelodyAlignment(query, song, helpers.DefaultAlignmentOptions)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown matcher %q, expected histogram, dtw or alignment", name)
+	}
+}
+
+// SearchMelody scores the query notes against every song passing filters and returns the params.TopK best
+// results scoring above params.MinScore, together with the number of songs passing filters
+// the index ruled out without scoring them.
+//
+// The histogram matcher narrows indexed songs down with the precomputed feature index: the
+// interval n-gram index picks candidates, which are ranked by their indexed windows. Only the
+// best of them are then scored from their notes file, like songs that are not indexed yet and
+// every song for the other matchers, so all returned scores come from the same matcher.
+func SearchMelody(db *gorm.DB, query []helpers.NoteEvent, matcherName string, params helpers.MelodyParams, filters SongFilters) ([]MelodyResult, int, error) {
+	match, err := NewMelodyMatcher(matcherName, params)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var songs []models.Song
+	if err := filters.Apply(db).Find(&songs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	indexedSongs := map[uint]bool{}
+	shortlist := map[uint]bool{}
+	pruned := 0
+	if matcherName == "histogram" {
+		if indexedSongs, err = IndexedSongIDs(db); err != nil {
+			return nil, 0, err
+		}
+		// Restrict the index to the songs passing filters, nil meaning every song
+		var songIDs []uint
+		if filters != (SongFilters{}) {
+			songIDs = make([]uint, 0, len(songs))
+			for _, song := range songs {
+				songIDs = append(songIDs, song.ID)
+			}
+		}
+		candidates, err := FindMelodyCandidates(db, query, songIDs)
+		if err != nil {
+			return nil, 0, err
+		}
+		indexMatches, err := ScoreSongsFromIndex(db, query, candidates, songIDs, params)
+		if err != nil {
+			return nil, 0, err
+		}
+		shortlist = shortlistIndexMatches(indexMatches, params.TopK*indexShortlistFactor)
+		for _, song := range songs {
+			if indexedSongs[song.ID] && !shortlist[song.ID] {
+				pruned++
+			}
+		}
+	}
+
+	results := scoreSongs(songs, params, func(song models.Song) (helpers.MelodyMatch, bool) {
+		if indexedSongs[song.ID] && !shortlist[song.ID] {
+			// Ruled out by the index
+			return helpers.MelodyMatch{}, false
+		}
+		songNotes, err := helpers.LoadMelodyFromJSON(song.MidiJSON)
+		if err != nil {
+			log.Printf("Failed to check similarity of %s: %v\n", song.Name, err)
+			return helpers.MelodyMatch{}, false
+		}
+		return match(query, songNotes), true
+	})
+	return results, pruned, nil
+}
+
+// SearchRhythm scores tap timestamps in seconds against the rhythm of the melody of every
+// song passing filters and returns the params.TopK best results scoring above params.MinScore
+func SearchRhythm(db *gorm.DB, taps []float64, params helpers.MelodyParams, filters SongFilters) ([]MelodyResult, error) {
+	var songs []models.Song
+	if err := filters.Apply(db).Find(&songs).Error; err != nil {
+		return nil, err
+	}
+
+	return scoreSongs(songs, params, func(song models.Song) (helpers.MelodyMatch, bool) {
+		songNotes, err := rhythmNotes(song)
+		if err != nil {
+			log.Printf("Failed to check rhythm of %s: %v\n", song.Name, err)
+			return helpers.MelodyMatch{}, false
+		}
+		return helpers.MatchRhythm(taps, songNotes), true
+	}), nil
+}
+
+// rhythmNotes returns the timed melody of a song. Notes files without timing are completed
+// from the song's MIDI file.
+func rhythmNotes(song models.Song) ([]helpers.NoteEvent, error) {
+	notes, err := helpers.LoadMelodyFromJSON(song.MidiJSON)
+	if err != nil || helpers.HasTiming(notes) {
+		return notes, err
+	}
+
+	midi, err := helpers.ParseMidiFile(song.AudioFilePathMidi)
+	if err != nil {
+		return nil, err
+	}
+	track := -1
+	if song.MelodyTrack != nil {
+		track = *song.MelodyTrack
+	}
+	melody, _, err := helpers.ExtractMelody(midi.NoteEvents(), track)
+	return melody, err
+}
+
+// shortlistIndexMatches returns the IDs of the n songs with the best index scores
+func shortlistIndexMatches(matches map[uint]helpers.MelodyMatch, n int) map[uint]bool {
+	songIDs := make([]uint, 0, len(matches))
+	for songID := range matches {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Slice(songIDs, func(i, j int) bool {
+		if matches[songIDs[i]].Score != matches[songIDs[j]].Score {
+			return matches[songIDs[i]].Score > matches[songIDs[j]].Score
+		}
+		return songIDs[i] < songIDs[j]
+	})
+	if len(songIDs) > n {
+		songIDs = songIDs[:n]
+	}
+
+	shortlist := make(map[uint]bool, len(songIDs))
+	for _, songID := range songIDs {
+		shortlist[songID] = true
+	}
+	return shortlist
+}
+
+// scoreSongs scores every song concurrently and returns the params.TopK best results scoring
+// above params.MinScore, best first. score reports false for songs to leave out.
+func scoreSongs(songs []models.Song, params helpers.MelodyParams, score func(song models.Song) (helpers.MelodyMatch, bool)) []MelodyResult {
+	resultChan := make(chan MelodyResult, len(songs))
+	var wg sync.WaitGroup
+	for _, song := range songs {
+		wg.Add(1)
+		go func(song models.Song) {
+			defer wg.Done()
+			songMatch, ok := score(song)
+			if !ok {
+				return
+			}
+			if songMatch.Score > params.MinScore {
+				resultChan <- MelodyResult{
+					ID:              song.ID,
+					Name:            song.Name,
+					AudioFilePath:   song.AudioFilePath,
+					AlbumID:         song.AlbumID,
+					SimilarityScore: songMatch.Score,
+					Match:           songMatch,
+				}
+			}
+		}(song)
+	}
+	wg.Wait()
+	close(resultChan)
+
+	var results []MelodyResult
+	for result := range resultChan {
+		results = append(results, result)
+	}
+
+	// Best first, limited to the top k
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].SimilarityScore > results[j].SimilarityScore
+	})
+	if len(results) > params.TopK {
+		results = results[:params.TopK]
+	}
+	return results
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// MigrateNotesJSON upgrades the MidiJSON file of every song not recorded as migrated from
+// the legacy pitch array to the versioned note-event format, recovering timing from the
+// song's MIDI file, and extracts the melody of files that do not have one yet
+func MigrateNotesJSON(db *gorm.DB) error {
+	var songs []models.Song
+	if err := db.Where("notes_version < ?", helpers.NotesFormatVersion).Find(&songs).Error; err != nil {
+		return err
+	}
+
+	upgraded, extracted := 0, 0
+	for _, song := range songs {
+		ok, err := helpers.UpgradeNotesJSON(song.MidiJSON, song.AudioFilePathMidi)
+		if err != nil {
+			log.Printf("Failed to upgrade notes of song %d (%s): %v\n", song.ID, song.MidiJSON, err)
+			continue
+		}
+		if ok {
+			upgraded++
+		}
+
+		// Songs stored before melody extraction only have the full note list. An empty melody
+		// is left out of the file too, so those are extracted once more and then recorded.
+		doc, _, err := helpers.LoadNotesDocument(song.MidiJSON)
+		if err != nil {
+			log.Printf("Failed to read notes of song %d (%s): %v\n", song.ID, song.MidiJSON, err)
+			continue
+		}
+		if doc.Melody != nil || len(doc.Notes) == 0 {
+			if err := recordNotesVersion(db, &song); err != nil {
+				log.Printf("Failed to record the notes version of song %d: %v\n", song.ID, err)
+			}
+			continue
+		}
+		if _, err := ExtractSongMelody(db, &song); err != nil {
+			log.Printf("Failed to extract melody of song %d (%s): %v\n", song.ID, song.MidiJSON, err)
+			continue
+		}
+		extracted++
+	}
+
+	if upgraded > 0 {
+		log.Printf("Upgraded %d notes files to format version %d\n", upgraded, helpers.NotesFormatVersion)
+	}
+	if extracted > 0 {
+		log.Printf("Extracted the melody of %d songs, run the reindex command to index it\n", extracted)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bos/pablo/helpers"
+	"bos/pablo/models"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// AnalyzeSong computes the key, tempo, time signature, duration, note count and pitch range
+// of a song from its notes and MIDI file, and stores them on the song
+func AnalyzeSong(db *gorm.DB, song *models.Song) error {
+	notes, err := helpers.LoadNotesFromJSON(song.MidiJSON)
+	if err != nil {
+		return err
+	}
+	// The MIDI file of a song converted from audio is written by the transcriber with a fixed
+	// tempo and meter, so only uploaded MIDI files tell the song's tempo and time signature
+	var midi *helpers.MidiFile
+	if helpers.IsMidiFile(song.AudioFilePath) {
+		if midi, err = helpers.ParseMidiFile(song.AudioFilePathMidi); err != nil {
+			midi = nil
+		}
+	}
+	analysis := helpers.AnalyzeSong(notes, midi)
+
+	song.EstimatedKey = nil
+	song.KeyConfidence = nil
+	if analysis.Key != "" {
+		song.EstimatedKey = &analysis.Key
+		song.KeyConfidence = &analysis.KeyConfidence
+	}
+	song.Tempo = analysis.Tempo
+	song.TimeSignature = analysis.TimeSignature
+	song.Duration = &analysis.Duration
+	song.NoteCount = &analysis.NoteCount
+	song.PitchMin = &analysis.PitchMin
+	song.PitchMax = &analysis.PitchMax
+
+	return db.Model(song).Select(
+		"EstimatedKey", "KeyConfidence", "Tempo", "TimeSignature", "Duration", "NoteCount", "PitchMin", "PitchMax",
+	).Updates(song).Error
+}
+
+// AnalyzeMissingSongs analyzes every song stored before song analysis existed, and songs
+// converted from audio that were given the transcriber's tempo or time signature
+func AnalyzeMissingSongs(db *gorm.DB) error {
+	// Only MIDI uploads carry their own tempo and time signature
+	var songs []models.Song
+	err := db.Where("note_count IS NULL").
+		Or("(tempo IS NOT NULL OR time_signature IS NOT NULL) AND LOWER(audio_file_path) NOT LIKE ? AND LOWER(audio_file_path) NOT LIKE ?", "%.mid", "%.midi").
+		Find(&songs).Error
+	if err != nil {
+		return err
+	}
+
+	analyzed := 0
+	for i := range songs {
+		if err := AnalyzeSong(db, &songs[i]); err != nil {
+			log.Printf("Failed to analyze song %d (%s): %v\n", songs[i].ID, songs[i].Name, err)
+			continue
+		}
+		analyzed++
+	}
+	if analyzed > 0 {
+		log.Printf("Analyzed %d songs\n", analyzed)
+	}
+	return nil
+}
+
+// SongFilters restricts songs by their analysis. Zero values do not filter.
+type SongFilters struct {
+	Key           string // e.g. "A minor"
+	Mode          string // "major" or "minor"
+	TimeSignature string // e.g. "3/4"
+	MinTempo      *float64
+	MaxTempo      *float64
+	MinDuration   *float64 // seconds
+	MaxDuration   *float64
+	MinNotes      *int
+	MaxNotes      *int
+	MinPitch      *int // lowest pitch the song may go down to
+	MaxPitch      *int // highest pitch the song may go up to
+}
+
+// ParseSongFilters reads key, mode, time_signature, min_tempo, max_tempo, min_duration,
+// max_duration, min_notes, max_notes, min_pitch and max_pitch through get
+func ParseSongFilters(get func(key string) (string, bool)) (SongFilters, error) {
+	var filters SongFilters
+	lookup := func(key string) (string, bool) {
+		value, ok := get(key)
+		value = strings.TrimSpace(value)
+		return value, ok && value != ""
+	}
+
+	if value, ok := lookup("key"); ok {
+		key, err := helpers.NormalizeKeyName(value)
+		if err != nil {
+			return filters, err
+		}
+		filters.Key = key
+	}
+	if value, ok := lookup("mode"); ok {
+		if value != "major" && value != "minor" {
+			return filters, fmt.Errorf("mode must be major or minor, got %q", value)
+		}
+		filters.Mode = value
+	}
+	if value, ok := lookup("time_signature"); ok {
+		filters.TimeSignature = value
+	}
+
+	for key, target := range map[string]**float64{
+		"min_tempo":    &filters.MinTempo,
+		"max_tempo":    &filters.MaxTempo,
+		"min_duration": &filters.MinDuration,
+		"max_duration": &filters.MaxDuration,
+	} {
+		if value, ok := lookup(key); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed < 0 {
+				return filters, fmt.Errorf("%s must be a non-negative number, got %q", key, value)
+			}
+			*target = &parsed
+		}
+	}
+	for key, target := range map[string]**int{
+		"min_notes": &filters.MinNotes,
+		"max_notes": &filters.MaxNotes,
+		"min_pitch": &filters.MinPitch,
+		"max_pitch": &filters.MaxPitch,
+	} {
+		if value, ok := lookup(key); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return filters, fmt.Errorf("%s must be a non-negative integer, got %q", key, value)
+			}
+			*target = &parsed
+		}
+	}
+	return filters, nil
+}
+
+// Apply adds the filters to a song query. Songs that have not been analyzed never match a
+// filter on the missing value.
+func (f SongFilters) Apply(query *gorm.DB) *gorm.DB {
+	if f.Key != "" {
+		query = query.Where("estimated_key = ?", f.Key)
+	}
+	if f.Mode != "" {
+		query = query.Where("estimated_key LIKE ?", "% "+f.Mode)
+	}
+	if f.TimeSignature != "" {
+		query = query.Where("time_signature = ?", f.TimeSignature)
+	}
+	if f.MinTempo != nil {
+		query = query.Where("tempo >= ?", *f.MinTempo)
+	}
+	if f.MaxTempo != nil {
+		query = query.Where("tempo <= ?", *f.MaxTempo)
+	}
+	if f.MinDuration != nil {
+		query = query.Where("duration >= ?", *f.MinDuration)
+	}
+	if f.MaxDuration != nil {
+		query = query.Where("duration <= ?", *f.MaxDuration)
+	}
+	if f.MinNotes != nil {
+		query = query.Where("note_count >= ?", *f.MinNotes)
+	}
+	if f.MaxNotes != nil {
+		query = query.Where("note_count <= ?", *f.MaxNotes)
+	}
+	if f.MinPitch != nil {
+		query = query.Where("pitch_min >= ?", *f.MinPitch)
+	}
+	if f.MaxPitch != nil {
+		query = query.Where("pitch_max <= ?", *f.MaxPitch)
+	}
+	return query
+}
@@ -0,0 +1,84 @@
+package types
+
+import "math"
+
+// SparseHistogram stores the non-zero bins of a histogram keyed by bin index
+type SparseHistogram map[int]float64
+
+// NewSparseHistogram keeps the non-zero bins of a dense histogram
+func NewSparseHistogram(dense []float64) SparseHistogram {
+	sparse := SparseHistogram{}
+	for i, value := range dense {
+		if value != 0 {
+			sparse[i] = value
+		}
+	}
+	return sparse
+}
+
+// Dense expands the histogram back to a slice of the given size
+func (h SparseHistogram) Dense(size int) []float64 {
+	dense := make([]float64, size)
+	for i, value := range h {
+		if i >= 0 && i < size {
+			dense[i] = value
+		}
+	}
+	return dense
+}
+
+// Norm returns the euclidean norm of the histogram
+func (h SparseHistogram) Norm() float64 {
+	var sum float64
+	for _, value := range h {
+		sum += value * value
+	}
+	return math.Sqrt(sum)
+}
+
+// FeatureWindow holds the melody histograms of one sliding window over a song
+type FeatureWindow struct {
+	Offset int             `json:"offset"`
+	Onset  float64         `json:"onset,omitempty"` // seconds, only set when the song has timing
+	ATB    SparseHistogram `json:"atb"`
+	RTB    SparseHistogram `json:"rtb"`
+	FTB    SparseHistogram `json:"ftb"`
+	IOI    SparseHistogram `json:"ioi,omitempty"` // nil when the song has no timing
+}
+
+// ColorFeatures describe the colors of an album cover, which the grayscale pixels ignore
+type ColorFeatures struct {
+	Version      int            `json:"version"`
+	HSV          []float64      `json:"hsv"`     // hue x saturation x value histogram
+	Lab          []float64      `json:"lab"`     // CIELAB histogram
+	Palette      []PaletteColor `json:"palette"` // dominant colors, most common first
+	RGBMean      [3]float64     `json:"rgbMean"`
+	RGBDeviation [3]float64     `json:"rgbDeviation"` // standard deviation along every principal axis
+	RGBAxes      [3][3]float64  `json:"rgbAxes"`      // unit principal axes of the RGB values, strongest first
+}
+
+// PaletteColor is one dominant color in CIELAB and the share of the pixels closest to it
+type PaletteColor struct {
+	L      float64 `json:"l"`
+	A      float64 `json:"a"`
+	B      float64 `json:"b"`
+	Weight float64 `json:"weight"`
+}
+
+// ImagePreprocessing are the steps that turn an image into a flattened grayscale vector
+type ImagePreprocessing struct {
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	Resample        string `json:"resample"` // nearest, bilinear, bicubic or lanczos
+	Fit             string `json:"fit"`      // stretch, crop or letterbox to the target aspect ratio
+	TrimBorders     bool   `json:"trimBorders"`
+	ExifOrientation bool   `json:"exifOrientation"` // turn JPEG photos upright
+}
+
+// ImageFeatureMeta records how the flattened vector of an album cover was computed
+type ImageFeatureMeta struct {
+	Preprocessing ImagePreprocessing `json:"preprocessing"`
+	SourceWidth   int                `json:"sourceWidth"`
+	SourceHeight  int                `json:"sourceHeight"`
+	Region        [4]int             `json:"region"` // x0, y0, x1, y1 of the source kept after trimming and cropping
+}
@@ -0,0 +1,298 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// jacobiMaxSweeps bounds the Jacobi sweeps of SVD and SymmetricEigen, which usually converge
+// in well under 20
+const jacobiMaxSweeps = 100
+
+// Zeros returns a rows by cols matrix of zeros
+func Zeros(rows, cols int) *Matrix {
+	data := make([][]float64, rows)
+	for i := range data {
+		data[i] = make([]float64, cols)
+	}
+	return NewMatrix(data)
+}
+
+// Identity returns the n by n identity matrix
+func Identity(n int) *Matrix {
+	m := Zeros(n, n)
+	for i := 0; i < n; i++ {
+		m.data[i][i] = 1
+	}
+	return m
+}
+
+// Shape returns the number of rows and columns, also for a matrix without rows
+func (m *Matrix) Shape() (int, int) {
+	if len(m.data) == 0 {
+		return 0, 0
+	}
+	return len(m.data), len(m.data[0])
+}
+
+// Clone returns a deep copy of the matrix
+func (m *Matrix) Clone() *Matrix {
+	data := make([][]float64, len(m.data))
+	for i, row := range m.data {
+		data[i] = append([]float64(nil), row...)
+	}
+	return NewMatrix(data)
+}
+
+// Column returns a copy of column j
+func (m *Matrix) Column(j int) []float64 {
+	column := make([]float64, len(m.data))
+	for i, row := range m.data {
+		column[i] = row[j]
+	}
+	return column
+}
+
+// Transpose returns the transposed matrix
+func (m *Matrix) Transpose() *Matrix {
+	rows, cols := m.Shape()
+	t := Zeros(cols, rows)
+	for i, row := range m.data {
+		for j, value := range row {
+			t.data[j][i] = value
+		}
+	}
+	return t
+}
+
+// Multiply returns the matrix product m × other
+func (m *Matrix) Multiply(other *Matrix) (*Matrix, error) {
+	rows, inner := m.Shape()
+	otherRows, cols := other.Shape()
+	if inner != otherRows {
+		return nil, fmt.Errorf("cannot multiply a %dx%d matrix by a %dx%d matrix", rows, inner, otherRows, cols)
+	}
+	product := Zeros(rows, cols)
+	for i, row := range m.data {
+		result := product.data[i]
+		for k, value := range row {
+			if value == 0 {
+				continue
+			}
+			for j, otherValue := range other.data[k] {
+				result[j] += value * otherValue
+			}
+		}
+	}
+	return product, nil
+}
+
+// ColumnMeans returns the mean of every column
+func (m *Matrix) ColumnMeans() []float64 {
+	rows, cols := m.Shape()
+	means := make([]float64, cols)
+	for _, row := range m.data {
+		for j, value := range row {
+			means[j] += value
+		}
+	}
+	for j := range means {
+		means[j] /= float64(rows)
+	}
+	return means
+}
+
+// Center returns the matrix with the mean of every column subtracted, and those means
+func (m *Matrix) Center() (*Matrix, []float64) {
+	means := m.ColumnMeans()
+	centered := m.Clone()
+	for _, row := range centered.data {
+		for j := range row {
+			row[j] -= means[j]
+		}
+	}
+	return centered, means
+}
+
+// Covariance returns the sample covariance matrix of the columns, taking every row as one
+// observation
+func (m *Matrix) Covariance() (*Matrix, error) {
+	rows, _ := m.Shape()
+	if rows < 2 {
+		return nil, errors.New("covariance needs at least 2 observations")
+	}
+	centered, _ := m.Center()
+	covariance, err := centered.Transpose().Multiply(centered)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range covariance.data {
+		for j := range row {
+			row[j] /= float64(rows - 1)
+		}
+	}
+	return covariance, nil
+}
+
+// SVD computes the thin singular value decomposition m = U diag(S) Vᵀ with one-sided Jacobi
+// rotations. For an r×c matrix and k = min(r, c), U is r×k, V is c×k, both with orthonormal
+// columns, and S holds the k singular values in decreasing order. Columns of U for zero
+// singular values are left zero.
+func (m *Matrix) SVD() (*Matrix, []float64, *Matrix) {
+	rows, cols := m.Shape()
+	if rows == 0 || cols == 0 {
+		return Zeros(rows, 0), nil, Zeros(cols, 0)
+	}
+	if rows < cols {
+		// m = (mᵀ)ᵀ = (U S Vᵀ)ᵀ = V S Uᵀ
+		u, s, v := m.Transpose().SVD()
+		return v, s, u
+	}
+
+	// Rotate pairs of columns until they are all orthogonal; work holds the columns as rows
+	work := m.Transpose().data
+	v := Identity(cols).data // v[j] is column j of V, stored as a row as well
+	for sweep := 0; sweep < jacobiMaxSweeps; sweep++ {
+		rotated := false
+		for p := 0; p < cols; p++ {
+			for q := p + 1; q < cols; q++ {
+				alpha, beta, gamma := dot(work[p], work[p]), dot(work[q], work[q]), dot(work[p], work[q])
+				if gamma == 0 || math.Abs(gamma) <= 1e-15*math.Sqrt(alpha*beta) {
+					continue
+				}
+				rotated = true
+				c, s := jacobiRotation(alpha, beta, gamma)
+				rotate(work[p], work[q], c, s)
+				rotate(v[p], v[q], c, s)
+			}
+		}
+		if !rotated {
+			break
+		}
+	}
+
+	// The column norms are the singular values
+	values := make([]float64, cols)
+	for j := range work {
+		values[j] = math.Sqrt(dot(work[j], work[j]))
+	}
+	order := decreasingOrder(values)
+
+	u, vm := Zeros(rows, cols), Zeros(cols, cols)
+	s := make([]float64, cols)
+	tolerance := 1e-13 * math.Max(values[order[0]], 1e-300)
+	for k, j := range order {
+		s[k] = values[j]
+		for i := 0; i < cols; i++ {
+			vm.data[i][k] = v[j][i]
+		}
+		if values[j] <= tolerance {
+			continue
+		}
+		for i := 0; i < rows; i++ {
+			u.data[i][k] = work[j][i] / values[j]
+		}
+	}
+	return u, s, vm
+}
+
+// SymmetricEigen diagonalizes a symmetric matrix with cyclic Jacobi rotations. It returns the
+// eigenvalues in decreasing order and the unit eigenvectors as the columns of the second result.
+func (m *Matrix) SymmetricEigen() ([]float64, *Matrix, error) {
+	n, cols := m.Shape()
+	if n != cols {
+		return nil, nil, fmt.Errorf("eigendecomposition needs a square matrix, got %dx%d", n, cols)
+	}
+	a := m.Clone().data
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if math.Abs(a[i][j]-a[j][i]) > 1e-9*(math.Abs(a[i][j])+math.Abs(a[j][i])+1) {
+				return nil, nil, errors.New("eigendecomposition needs a symmetric matrix")
+			}
+		}
+	}
+	v := Identity(n).data // v[j] is eigenvector j, stored as a row
+
+	for sweep := 0; sweep < jacobiMaxSweeps; sweep++ {
+		var offDiagonal, diagonal float64
+		for p := 0; p < n; p++ {
+			diagonal += a[p][p] * a[p][p]
+			for q := p + 1; q < n; q++ {
+				offDiagonal += a[p][q] * a[p][q]
+			}
+		}
+		if offDiagonal <= 1e-30*diagonal || offDiagonal == 0 {
+			break
+		}
+
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				// The rotation that zeroes a[p][q] is the one-sided rotation of the Gram
+				// entries a[p][p], a[q][q] and a[p][q]
+				c, s := jacobiRotation(a[p][p], a[q][q], a[p][q])
+				for r := 0; r < n; r++ {
+					arp, arq := a[r][p], a[r][q]
+					a[r][p], a[r][q] = c*arp-s*arq, s*arp+c*arq
+				}
+				rotate(a[p], a[q], c, s)
+				rotate(v[p], v[q], c, s)
+			}
+		}
+	}
+
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = a[i][i]
+	}
+	order := decreasingOrder(values)
+
+	sorted := make([]float64, n)
+	vectors := Zeros(n, n)
+	for k, j := range order {
+		sorted[k] = values[j]
+		for i := 0; i < n; i++ {
+			vectors.data[i][k] = v[j][i]
+		}
+	}
+	return sorted, vectors, nil
+}
+
+// jacobiRotation returns the cosine and sine of the rotation that makes two vectors with
+// squared norms alpha and beta and dot product gamma orthogonal
+func jacobiRotation(alpha, beta, gamma float64) (float64, float64) {
+	zeta := (beta - alpha) / (2 * gamma)
+	t := math.Copysign(1, zeta) / (math.Abs(zeta) + math.Sqrt(1+zeta*zeta))
+	c := 1 / math.Sqrt(1+t*t)
+	return c, c * t
+}
+
+// rotate replaces x and y with c·x − s·y and s·x + c·y
+func rotate(x, y []float64, c, s float64) {
+	for i := range x {
+		xi, yi := x[i], y[i]
+		x[i], y[i] = c*xi-s*yi, s*xi+c*yi
+	}
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// decreasingOrder returns the indexes of values from largest to smallest
+func decreasingOrder(values []float64) []int {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return values[order[i]] > values[order[j]] })
+	return order
+}
@@ -0,0 +1,163 @@
+package types
+
+import (
+	"math"
+	"testing"
+)
+
+const tolerance = 1e-9
+
+func assertMatrix(t *testing.T, name string, got *Matrix, want [][]float64) {
+	t.Helper()
+	rows, cols := got.Shape()
+	if rows != len(want) || (rows > 0 && cols != len(want[0])) {
+		t.Fatalf("%s: got a %dx%d matrix, want %dx%d", name, rows, cols, len(want), len(want[0]))
+	}
+	for i := range want {
+		for j := range want[i] {
+			if math.Abs(got.Get(i, j)-want[i][j]) > tolerance {
+				t.Fatalf("%s[%d][%d] = %g, want %g", name, i, j, got.Get(i, j), want[i][j])
+			}
+		}
+	}
+}
+
+// assertOrthonormalColumns checks that the columns of m are unit vectors orthogonal to each
+// other, skipping the columns listed in zero, which must be all zeros
+func assertOrthonormalColumns(t *testing.T, name string, m *Matrix, zero map[int]bool) {
+	t.Helper()
+	_, cols := m.Shape()
+	for p := 0; p < cols; p++ {
+		for q := p; q < cols; q++ {
+			want := 0.0
+			if p == q && !zero[p] {
+				want = 1
+			}
+			if got := dot(m.Column(p), m.Column(q)); math.Abs(got-want) > tolerance {
+				t.Fatalf("%s: column %d · column %d = %g, want %g", name, p, q, got, want)
+			}
+		}
+	}
+}
+
+func TestMultiply(t *testing.T) {
+	a := NewMatrix([][]float64{{1, 2, 3}, {4, 5, 6}})
+	b := NewMatrix([][]float64{{7, 8}, {9, 10}, {11, 12}})
+
+	product, err := a.Multiply(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMatrix(t, "a×b", product, [][]float64{{58, 64}, {139, 154}})
+
+	if _, err := a.Multiply(a); err == nil {
+		t.Fatal("multiplying a 2x3 matrix by a 2x3 matrix should fail")
+	}
+}
+
+func TestTranspose(t *testing.T) {
+	a := NewMatrix([][]float64{{1, 2, 3}, {4, 5, 6}})
+	assertMatrix(t, "aᵀ", a.Transpose(), [][]float64{{1, 4}, {2, 5}, {3, 6}})
+}
+
+func TestCovariance(t *testing.T) {
+	// Column means are 2 and 4; deviations (-1, 0, 1) and (-2, 0, 2) over 2 degrees of freedom
+	observations := NewMatrix([][]float64{{1, 2}, {2, 4}, {3, 6}})
+	covariance, err := observations.Covariance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMatrix(t, "covariance", covariance, [][]float64{{1, 2}, {2, 4}})
+
+	if _, err := NewMatrix([][]float64{{1, 2}}).Covariance(); err == nil {
+		t.Fatal("covariance of a single observation should fail")
+	}
+}
+
+func TestSVD(t *testing.T) {
+	tests := []struct {
+		name string
+		data [][]float64
+		rank int
+	}{
+		{"tall", [][]float64{{1, 2}, {3, 4}, {5, 6}, {7, 9}}, 2},
+		{"wide", [][]float64{{2, 0, 1, -1}, {1, 3, 0, 2}}, 2},
+		{"rank deficient", [][]float64{{1, 2, 3}, {2, 4, 6}, {1, 0, 1}, {3, 4, 7}}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewMatrix(test.data)
+			rows, cols := a.Shape()
+			k := min(rows, cols)
+
+			u, s, v := a.SVD()
+			if r, c := u.Shape(); r != rows || c != k {
+				t.Fatalf("U is %dx%d, want %dx%d", r, c, rows, k)
+			}
+			if r, c := v.Shape(); r != cols || c != k {
+				t.Fatalf("V is %dx%d, want %dx%d", r, c, cols, k)
+			}
+			if len(s) != k {
+				t.Fatalf("got %d singular values, want %d", len(s), k)
+			}
+
+			zero := map[int]bool{}
+			for i, value := range s {
+				if i > 0 && value > s[i-1] {
+					t.Fatalf("singular values %v are not decreasing", s)
+				}
+				if i >= test.rank {
+					if value > tolerance {
+						t.Fatalf("singular value %d = %g, want 0 for rank %d", i, value, test.rank)
+					}
+					zero[i] = true
+				}
+			}
+			assertOrthonormalColumns(t, "U", u, zero)
+			assertOrthonormalColumns(t, "V", v, nil)
+
+			// U·diag(S)·Vᵀ reconstructs the matrix
+			scaled := u.Clone()
+			for _, row := range scaled.data {
+				for j := range row {
+					row[j] *= s[j]
+				}
+			}
+			reconstructed, err := scaled.Multiply(v.Transpose())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertMatrix(t, "U·diag(S)·Vᵀ", reconstructed, test.data)
+		})
+	}
+}
+
+func TestSymmetricEigen(t *testing.T) {
+	// Eigenvalues 4, 2 and 1 with eigenvectors (1, 1, 0)/√2, (1, -1, 0)/√2 and (0, 0, 1)
+	a := NewMatrix([][]float64{{3, 1, 0}, {1, 3, 0}, {0, 0, 1}})
+	values, vectors, err := a.SymmetricEigen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantValues := []float64{4, 2, 1}
+	r := 1 / math.Sqrt2
+	wantVectors := [][]float64{{r, r, 0}, {r, -r, 0}, {0, 0, 1}}
+	for k, want := range wantValues {
+		if math.Abs(values[k]-want) > tolerance {
+			t.Fatalf("eigenvalue %d = %g, want %g", k, values[k], want)
+		}
+		// Eigenvectors are only defined up to their sign
+		vector := vectors.Column(k)
+		sign := math.Copysign(1, dot(vector, wantVectors[k]))
+		for i := range vector {
+			if math.Abs(sign*vector[i]-wantVectors[k][i]) > tolerance {
+				t.Fatalf("eigenvector %d = %v, want ±%v", k, vector, wantVectors[k])
+			}
+		}
+	}
+
+	if _, _, err := NewMatrix([][]float64{{1, 2}, {3, 4}}).SymmetricEigen(); err == nil {
+		t.Fatal("eigendecomposition of a non-symmetric matrix should fail")
+	}
+}
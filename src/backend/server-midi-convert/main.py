@@ -1,11 +1,11 @@
 from basic_pitch.inference import predict_and_save
 from basic_pitch import ICASSP_2022_MODEL_PATH
+import base64
 import os
-from fastapi import FastAPI, HTTPException
-from pydantic import BaseModel
-from mido import MidiFile
-import json
-import uuid
+import shutil
+import tempfile
+from fastapi import FastAPI, HTTPException, UploadFile
+from mido import MidiFile, tick2second
 import logging
 
 
@@ -17,42 +17,43 @@ logger = logging.getLogger('uvicorn.error')
 app = FastAPI()
 
 
-class FilePathRequest(BaseModel):
-    file_path: str
-
-
 @app.post("/convert-to-midi/")
-async def convert_to_midi(request: FilePathRequest):
+async def convert_to_midi(file: UploadFile):
     """
-    Convert an audio file from the given path to MIDI format.
+    Convert an uploaded audio file to MIDI format.
+    Returns the MIDI file base64 encoded together with its note events,
+    nothing is kept on this host.
     """
-    file_path = f"..\go\{request.file_path}"
-    logger.info(f"Received file path: {file_path}")
-
-    if not os.path.exists(file_path):
-        logger.error(f"File not found: {file_path}")
-        raise HTTPException(status_code=404, detail="File not found")
+    logger.info(f"Received file: {file.filename}")
 
+    work_dir = tempfile.mkdtemp(prefix="convert-")
     try:
+        file_path = os.path.join(work_dir, os.path.basename(file.filename or "upload"))
+        with open(file_path, "wb") as out:
+            shutil.copyfileobj(file.file, out)
+
         if file_path.lower().endswith(".mid"):
             logger.info("File is already a MIDI file. Skipping conversion.")
-            midi_file_path = os.path.abspath(file_path)
+            midi_file_path = file_path
         else:
             midi_file_path = convert_audio_to_midi(file_path)
 
-        full_midi_path = os.path.abspath(midi_file_path)
-        midi_data_array = convert_midi_to_array(midi_file_path)
-        json_file_path = save_midi_array_to_json(midi_data_array, midi_file_path, os.path.basename(file_path))
+        notes = convert_midi_to_notes(midi_file_path)
+        with open(midi_file_path, "rb") as midi_file:
+            midi_data = base64.b64encode(midi_file.read()).decode("ascii")
 
-        
-        # Return the full path of the generated MIDI file
-        logger.info(f"MIDI file created at: {full_midi_path}")
-        return {"full_path": full_midi_path, "json_file_path": json_file_path}
+        logger.info(f"MIDI conversion successful, {len(notes)} notes")
+        return {
+            "midi": midi_data,
+            "notes": {"version": NOTES_FORMAT_VERSION, "timed": True, "notes": notes},
+        }
     except Exception as e:
         logger.error(f"Error processing file: {str(e)}")
         raise HTTPException(
             status_code=500, detail=f"Error processing file: {str(e)}"
         )
+    finally:
+        shutil.rmtree(work_dir, ignore_errors=True)
 
 
 def convert_audio_to_midi(file_path: str) -> str:
@@ -78,32 +79,65 @@ def convert_audio_to_midi(file_path: str) -> str:
     output_filename = f"{os.path.splitext(os.path.basename(file_path))[0]}_basic_pitch.mid"
     return os.path.join(output_dir, output_filename)
 
-# Helper Function: Convert MIDI to Array
-def convert_midi_to_array(midi_file_path: str):
+# Version of the note-event JSON format read by the Go backend
+NOTES_FORMAT_VERSION = 2
+
+
+# Helper Function: Convert MIDI to note events
+def convert_midi_to_notes(midi_file_path: str):
     """
-    Parse a MIDI file and convert its content to an array of integers.
-    Each integer represents a MIDI note that is on.
+    Parse a MIDI file into note events with onset and duration in seconds,
+    velocity, channel and track, sorted by onset.
     """
-    midi_data_array = []
     midi = MidiFile(midi_file_path)
 
+    # Tempo changes can live in any track, collect them into one map
+    tempo_map = []
     for track in midi.tracks:
+        tick = 0
         for msg in track:
-            if msg.type == "note_on" and msg.velocity > 0:
-                midi_data_array.append(msg.note)
-
-    return midi_data_array
-
-# Helper Function: Save MIDI Array to JSON
-def save_midi_array_to_json(midi_data_array, midi_file_path, original_filename):
-    output_dir = os.path.dirname(midi_file_path)
-    unique_id = uuid.uuid4().hex
-    json_filename = f"{os.path.splitext(original_filename)[0]}_{unique_id}_data.json"
-    json_file_path = os.path.join(output_dir, json_filename)
+            tick += msg.time
+            if msg.type == "set_tempo":
+                tempo_map.append((tick, msg.tempo))
+    tempo_map.sort()
+
+    def tick_to_seconds(tick):
+        seconds, last_tick, tempo = 0.0, 0, 500000
+        for change_tick, change_tempo in tempo_map:
+            if change_tick >= tick:
+                break
+            seconds += tick2second(change_tick - last_tick, midi.ticks_per_beat, tempo)
+            last_tick, tempo = change_tick, change_tempo
+        return seconds + tick2second(tick - last_tick, midi.ticks_per_beat, tempo)
+
+    notes = []
+    for track_index, track in enumerate(midi.tracks):
+        tick = 0
+        pending = {}
+
+        def close_note(key, end_tick):
+            start_tick, velocity = pending[key].pop(0)
+            onset = tick_to_seconds(start_tick)
+            notes.append({
+                "pitch": key[1],
+                "onset": onset,
+                "duration": tick_to_seconds(end_tick) - onset,
+                "velocity": velocity,
+                "channel": key[0],
+                "track": track_index,
+            })
 
-    json_data = json.dumps(midi_data_array, separators=(',', ':'))
+        for msg in track:
+            tick += msg.time
+            if msg.type == "note_on" and msg.velocity > 0:
+                pending.setdefault((msg.channel, msg.note), []).append((tick, msg.velocity))
+            elif msg.type in ("note_on", "note_off") and pending.get((msg.channel, msg.note)):
+                close_note((msg.channel, msg.note), tick)
 
-    with open(json_file_path, "w") as json_file:
-        json_file.write(json_data)
+        # Notes still sounding at the end of the track end with the track
+        for key, queue in pending.items():
+            while queue:
+                close_note(key, tick)
 
-    return json_file_path
+    notes.sort(key=lambda note: (note["onset"], -note["pitch"]))
+    return notes